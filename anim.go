@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+
+	"golang.org/x/image/draw"
+)
+
+const defaultAnimFrames = 8
+const maxAnimFrames = 24
+const defaultAnimFPS = 4
+const maxAnimFPS = 25
+
+// Attributes which can be animated from one value to another, and their canonical names.
+var animatableAttrs = map[string]string{
+	"gscale":   "gscale",
+	"g":        "gscale",
+	"infsteps": "infsteps",
+	"i":        "infsteps",
+}
+
+type AnimParams struct {
+	Frames    int
+	FPS       int
+	ToSeed    uint64
+	ToSeedSet bool
+	ToPrompt  string
+	// If set, the attribute's value is changed linearly from From to To.
+	Attr     string
+	From, To float64
+}
+
+// Composes the images into an animated GIF, which loops forever.
+func composeGIF(imgs [][]byte, fps int) ([]byte, error) {
+	if len(imgs) == 0 {
+		return nil, fmt.Errorf("no frames")
+	}
+
+	anim := gif.GIF{}
+	var bounds image.Rectangle
+	for i, b := range imgs {
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			bounds = image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+
+		frame := image.NewPaletted(bounds, palette.Plan9)
+		if img.Bounds().Dx() == bounds.Dx() && img.Bounds().Dy() == bounds.Dy() {
+			draw.FloydSteinberg.Draw(frame, bounds, img, img.Bounds().Min)
+		} else {
+			scaled := image.NewRGBA(bounds)
+			draw.ApproxBiLinear.Scale(scaled, bounds, img, img.Bounds(), draw.Src, nil)
+			draw.FloydSteinberg.Draw(frame, bounds, scaled, image.Point{})
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 100/fps)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &anim); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"golang.org/x/image/draw"
+)
+
+const defaultExtendPx = 256
+const minExtendPx = 64
+const maxExtendPx = 1024
+const extendMaskOverlap = 16 // The mask covers this much of the original image to hide the seam.
+const extendPromptStrength = 0.95
+const extendJPEGQuality = 95
+
+type ExtendParams struct {
+	Dir string // left, right, up or down.
+	Px  int
+}
+
+func (e *ExtendParams) isHorizontal() bool {
+	return e.Dir == "left" || e.Dir == "right"
+}
+
+// Downloads the largest size of the photo.
+func downloadPhoto(ctx context.Context, photo []models.PhotoSize) ([]byte, error) {
+	if len(photo) == 0 {
+		return nil, fmt.Errorf("no photo")
+	}
+	largest := photo[0]
+	for _, p := range photo[1:] {
+		if p.Width*p.Height > largest.Width*largest.Height {
+			largest = p
+		}
+	}
+
+	file, err := telegramBot.GetFile(ctx, &bot.GetFileParams{FileID: largest.FileID})
+	if err != nil {
+		return nil, fmt.Errorf("can't get photo: %w", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", "https://api.telegram.org/file/bot"+params.BotToken+"/"+
+		file.FilePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("can't download photo: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't download photo: got http status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Returns the image padded in the given direction and the inpainting mask of the new area. The image is
+// scaled down if needed to fit the max. image size, and the result size is a multiple of the image size step.
+func padImage(imgData []byte, e *ExtendParams) (padded, mask []byte, width, height int, err error) {
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("can't decode photo: %w", err)
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	maxW, maxH := maxImageSize, maxImageSize
+	if e.isHorizontal() {
+		maxW -= e.Px
+	} else {
+		maxH -= e.Px
+	}
+	scale := 1.0
+	if w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if h > maxH && float64(maxH)/float64(h) < scale {
+		scale = float64(maxH) / float64(h)
+	}
+	w = int(float64(w)*scale) / imageSizeStep * imageSizeStep
+	h = int(float64(h)*scale) / imageSizeStep * imageSizeStep
+	if w < minImageSize || h < minImageSize {
+		return nil, nil, 0, 0, fmt.Errorf("photo is too small")
+	}
+
+	// The original image's rectangle and the padding's rectangle in the result image.
+	var imgRect, padRect image.Rectangle
+	switch e.Dir {
+	case "left":
+		width, height = w+e.Px, h
+		imgRect, padRect = image.Rect(e.Px, 0, width, height), image.Rect(0, 0, e.Px, height)
+	case "right":
+		width, height = w+e.Px, h
+		imgRect, padRect = image.Rect(0, 0, w, height), image.Rect(w, 0, width, height)
+	case "up":
+		width, height = w, h+e.Px
+		imgRect, padRect = image.Rect(0, e.Px, width, height), image.Rect(0, 0, width, e.Px)
+	default:
+		width, height = w, h+e.Px
+		imgRect, padRect = image.Rect(0, 0, width, h), image.Rect(0, h, width, height)
+	}
+
+	res := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(res, imgRect, img, img.Bounds(), draw.Src, nil)
+
+	// The padding is filled by stretching the image's edge, so the new area gets matching colors.
+	var edge image.Rectangle
+	switch e.Dir {
+	case "left":
+		edge = image.Rect(imgRect.Min.X, 0, imgRect.Min.X+1, height)
+	case "right":
+		edge = image.Rect(imgRect.Max.X-1, 0, imgRect.Max.X, height)
+	case "up":
+		edge = image.Rect(0, imgRect.Min.Y, width, imgRect.Min.Y+1)
+	default:
+		edge = image.Rect(0, imgRect.Max.Y-1, width, imgRect.Max.Y)
+	}
+	edgeImg := image.NewRGBA(edge)
+	draw.Draw(edgeImg, edge, res, edge.Min, draw.Src)
+	draw.NearestNeighbor.Scale(res, padRect, edgeImg, edge, draw.Src, nil)
+
+	maskImg := image.NewGray(res.Bounds())
+	maskRect := padRect
+	switch e.Dir {
+	case "left":
+		maskRect.Max.X += extendMaskOverlap
+	case "right":
+		maskRect.Min.X -= extendMaskOverlap
+	case "up":
+		maskRect.Max.Y += extendMaskOverlap
+	default:
+		maskRect.Min.Y -= extendMaskOverlap
+	}
+	draw.Draw(maskImg, maskRect, image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, res, &jpeg.Options{Quality: extendJPEGQuality}); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	padded = buf.Bytes()
+
+	var maskBuf bytes.Buffer
+	if err = png.Encode(&maskBuf, maskImg); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	return padded, maskBuf.Bytes(), width, height, nil
+}
+
+// Pads the photo and sets up the render params to inpaint the new area.
+func (p *RenderParams) applyExtend(photo []byte) (err error) {
+	p.InitImage, p.Mask, p.Width, p.Height, err = padImage(photo, p.Extend)
+	if err != nil {
+		return err
+	}
+	p.PromptStrength = extendPromptStrength
+	return nil
+}
@@ -6,3 +6,5 @@ require (
 	github.com/go-telegram/bot v0.7.14
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63
 )
+
+require golang.org/x/image v0.11.0
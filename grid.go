@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const gridLabelPadding = 4
+const gridLabelBaseCellWidth = 256   // Labels are scaled up for cells wider than this.
+const gridMaxWidthPlusHeight = 10000 // Telegram's limit for photos.
+const gridJPEGQuality = 90
+
+// Renders the text with the basic font, scaled up by the given factor.
+func renderGridLabel(text string, scale int) image.Image {
+	face := basicfont.Face7x13
+	w := font.MeasureString(face, text).Ceil()
+	h := face.Metrics().Height.Ceil()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.Black,
+		Face: face,
+		Dot:  fixed.P(0, face.Metrics().Ascent.Ceil()),
+	}
+	d.DrawString(text)
+
+	if scale <= 1 {
+		return img
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, w*scale, h*scale))
+	draw.NearestNeighbor.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return scaled
+}
+
+// Composes the images into a grid, row by row. Column labels are drawn on the top, row labels on the left side.
+func composeGrid(imgs [][]byte, colLabels, rowLabels []string) ([]byte, error) {
+	cols := len(colLabels)
+	if cols == 0 {
+		cols = 1
+	}
+	rows := len(rowLabels)
+	if rows == 0 {
+		rows = 1
+	}
+	if len(imgs) != cols*rows {
+		return nil, fmt.Errorf("got %d images for a %dx%d grid", len(imgs), cols, rows)
+	}
+
+	var decoded []image.Image
+	for _, b := range imgs {
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, img)
+	}
+	cellWidth := decoded[0].Bounds().Dx()
+	cellHeight := decoded[0].Bounds().Dy()
+
+	scale := cellWidth / gridLabelBaseCellWidth
+	if scale < 1 {
+		scale = 1
+	}
+	padding := gridLabelPadding * scale
+
+	var colLabelImgs, rowLabelImgs []image.Image
+	var top, left int
+	for _, l := range colLabels {
+		img := renderGridLabel(l, scale)
+		colLabelImgs = append(colLabelImgs, img)
+		if h := img.Bounds().Dy() + 2*padding; h > top {
+			top = h
+		}
+	}
+	for _, l := range rowLabels {
+		img := renderGridLabel(l, scale)
+		rowLabelImgs = append(rowLabelImgs, img)
+		if w := img.Bounds().Dx() + 2*padding; w > left {
+			left = w
+		}
+	}
+
+	grid := image.NewRGBA(image.Rect(0, 0, left+cols*cellWidth, top+rows*cellHeight))
+	draw.Draw(grid, grid.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for i, img := range colLabelImgs {
+		b := img.Bounds()
+		x := left + i*cellWidth + (cellWidth-b.Dx())/2
+		draw.Draw(grid, b.Add(image.Pt(x, padding)), img, image.Point{}, draw.Src)
+	}
+	for i, img := range rowLabelImgs {
+		b := img.Bounds()
+		y := top + i*cellHeight + (cellHeight-b.Dy())/2
+		draw.Draw(grid, b.Add(image.Pt(padding, y)), img, image.Point{}, draw.Src)
+	}
+	for i, img := range decoded {
+		cell := image.Rect(0, 0, cellWidth, cellHeight).Add(image.Pt(left+(i%cols)*cellWidth, top+(i/cols)*cellHeight))
+		if img.Bounds().Dx() == cellWidth && img.Bounds().Dy() == cellHeight {
+			draw.Draw(grid, cell, img, img.Bounds().Min, draw.Src)
+		} else {
+			draw.ApproxBiLinear.Scale(grid, cell, img, img.Bounds(), draw.Src, nil)
+		}
+	}
+
+	var res image.Image = grid
+	if w, h := grid.Bounds().Dx(), grid.Bounds().Dy(); w+h > gridMaxWidthPlusHeight {
+		scaled := image.NewRGBA(image.Rect(0, 0, w*gridMaxWidthPlusHeight/(w+h), h*gridMaxWidthPlusHeight/(w+h)))
+		draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), grid, grid.Bounds(), draw.Src, nil)
+		res = scaled
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, res, &jpeg.Options{Quality: gridJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
+	"time"
+	"unicode/utf8"
 )
 
+const maxRetryDelay = 30 * time.Second
+
 func getProgressbar(progressPercent, progressBarLen int) (progressBar string) {
 	i := 0
 	for ; i < progressPercent/(100/progressBarLen); i++ {
@@ -15,3 +20,29 @@ func getProgressbar(progressPercent, progressBarLen int) (progressBar string) {
 	progressBar += " " + fmt.Sprint(progressPercent) + "%"
 	return
 }
+
+// Returns the exponential backoff delay with jitter for the given retry number (starting from 1).
+func getRetryDelay(retryNr int) time.Duration {
+	d := params.RetryDelay
+	for i := 1; i < retryNr && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	// Random jitter between d/2 and d.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Truncates the string to max. the given byte length without splitting UTF-8 characters.
+func truncateString(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	const ellipsis = "..."
+	s = s[:maxLen-len(ellipsis)]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + ellipsis
+}
@@ -3,13 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
-	"math/big"
-	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -33,123 +32,50 @@ func sendReplyToMessage(ctx context.Context, replyToMsg *models.Message, s strin
 	return
 }
 
-func handleCmdED(ctx context.Context, msg *models.Message) {
-	renderParams := RenderParams{
-		OrigPrompt:        msg.Text,
-		Seed:              rand.Uint32(),
-		Width:             512,
-		Height:            512,
-		NumInferenceSteps: 20,
-		NumOutputs:        4,
-		GuidanceScale:     7,
-		SamplerName:       params.DefaultSampler,
-		ModelName:         params.DefaultModel,
-	}
-
-	var prompt []string
-	var promptLine string
+func isAdmin(userID int64) bool {
+	return slices.Contains(params.AdminUserIDs, userID)
+}
 
-	lines := strings.Split(msg.Text, "\n")
-	if len(lines) >= 2 {
-		promptLine = strings.TrimSpace(lines[0])
-		renderParams.NegativePrompt = strings.TrimSpace(strings.Join(lines[1:], " "))
-	} else {
-		promptLine = strings.TrimSpace(msg.Text)
+func sendMessageToAdmins(ctx context.Context, s string) {
+	for _, chatID := range params.AdminUserIDs {
+		_, _ = telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: chatID,
+			Text:   s,
+		})
 	}
+}
 
-	words := strings.Split(promptLine, " ")
-	for i := range words {
-		words[i] = strings.TrimSpace(words[i])
+func handleCmdED(ctx context.Context, msg *models.Message, mode RenderMode) {
+	renderParams, err := getRenderParams(msg.Text, msg.From.ID, mode)
+	if err != nil {
+		fmt.Println("  error:", err)
+		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
+		return
+	}
 
-		if words[i][0] != '-' { // Only process words starting with -
-			prompt = append(prompt, words[i])
-			continue
-		}
+	dlQueue.Add(renderParams, msg)
+}
 
-		splitword := strings.Split(words[i], ":")
-		if len(splitword) == 2 {
-			attr := strings.ToLower(splitword[0][1:])
-			val := splitword[1]
-
-			switch attr {
-			case "seed", "s":
-				val = strings.TrimPrefix(val, "🌱")
-				val = strings.TrimPrefix(val, "0x")
-				valInt := new(big.Int)
-				if _, ok := valInt.SetString(val, 16); !ok {
-					fmt.Println("  invalid seed")
-					sendReplyToMessage(ctx, msg, errorStr+": invalid seed")
-					return
-				}
-				renderParams.Seed = uint32(valInt.Uint64())
-			case "width", "w":
-				valInt, err := strconv.Atoi(val)
-				if err != nil {
-					fmt.Println("  invalid width")
-					sendReplyToMessage(ctx, msg, errorStr+": invalid width")
-					return
-				}
-				renderParams.Width = valInt
-			case "height", "h":
-				valInt, err := strconv.Atoi(val)
-				if err != nil {
-					fmt.Println("  invalid height")
-					sendReplyToMessage(ctx, msg, errorStr+": invalid height")
-					return
-				}
-				renderParams.Height = valInt
-			case "infsteps", "i":
-				valInt, err := strconv.Atoi(val)
-				if err != nil {
-					fmt.Println("  invalid inference steps")
-					sendReplyToMessage(ctx, msg, errorStr+": invalid inference steps")
-					return
-				}
-				renderParams.NumInferenceSteps = valInt
-			case "outcnt", "o":
-				valInt, err := strconv.Atoi(val)
-				if err != nil {
-					fmt.Println("  invalid output count")
-					sendReplyToMessage(ctx, msg, errorStr+": invalid output count")
-					return
-				}
-				renderParams.NumOutputs = valInt
-			case "gscale", "g":
-				valFloat, err := strconv.ParseFloat(val, 32)
-				if err != nil {
-					fmt.Println("  invalid guidance scale")
-					sendReplyToMessage(ctx, msg, errorStr+": invalid guidance scale")
-					return
-				}
-				renderParams.GuidanceScale = float32(valFloat)
-			case "sampler", "r":
-				val = strings.ToLower(val)
-				switch val {
-				case "plms", "ddim", "heun", "euler", "euler_a", "dpm2", "dpm2_a", "lms",
-					"dpm_solver_stability", "dpmpp_2s_a", "dpmpp_2m", "dpmpp_2m_sde",
-					"dpmpp_sde", "dpm_adaptive", "ddpm", "deis", "unipc_snr", "unipc_tu",
-					"unipc_snr_2", "unipc_tu_2", "unipc_tq":
-					renderParams.SamplerName = val
-				default:
-					fmt.Println("  invalid sampler")
-					sendReplyToMessage(ctx, msg, errorStr+": invalid sampler")
-					return
-				}
-			case "model", "m":
-				renderParams.ModelName = val
-			default:
-				fmt.Println("  invalid attribute", attr)
-				sendReplyToMessage(ctx, msg, errorStr+": invalid attribute "+attr)
-				return
-			}
-		}
+func handleCmdEDExtend(ctx context.Context, msg *models.Message) {
+	if msg.ReplyToMessage == nil || len(msg.ReplyToMessage.Photo) == 0 {
+		sendReplyToMessage(ctx, msg, errorStr+": reply to a photo to extend it")
+		return
 	}
 
-	renderParams.Prompt = strings.Join(prompt, " ")
+	renderParams, err := getRenderParams(msg.Text, msg.From.ID, RenderModeExtend)
+	if err != nil {
+		fmt.Println("  error:", err)
+		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
+		return
+	}
 
-	if renderParams.Prompt == "" {
-		fmt.Println("  missing prompt")
-		sendReplyToMessage(ctx, msg, errorStr+": missing prompt")
+	photo, err := downloadPhoto(ctx, msg.ReplyToMessage.Photo)
+	if err == nil {
+		err = renderParams.applyExtend(photo)
+	}
+	if err != nil {
+		fmt.Println("  error:", err)
+		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
 		return
 	}
 
@@ -157,9 +83,43 @@ func handleCmdED(ctx context.Context, msg *models.Message) {
 }
 
 func handleCmdEDCancel(ctx context.Context, msg *models.Message) {
-	if err := dlQueue.CancelCurrentEntry(ctx); err != nil {
+	admin := isAdmin(msg.From.ID)
+	arg := strings.ToLower(strings.TrimSpace(msg.Text))
+
+	var match func(e *DownloadQueueEntry) bool
+	switch {
+	case arg == "all": // Admins cancel all requests, users their own.
+		match = func(e *DownloadQueueEntry) bool { return admin || e.Message.From.ID == msg.From.ID }
+	case arg != "":
+		id, err := strconv.ParseUint(strings.TrimPrefix(arg, "#"), 10, 64)
+		if err != nil {
+			sendReplyToMessage(ctx, msg, errorStr+": invalid request id")
+			return
+		}
+		match = func(e *DownloadQueueEntry) bool { return e.ID == id }
+	case msg.ReplyToMessage != nil:
+		match = func(e *DownloadQueueEntry) bool { return e.isMessageOf(msg.ReplyToMessage) }
+	default:
+		id, ok := dlQueue.GetDefaultCancelEntryID(msg.From.ID, admin)
+		if !ok {
+			sendReplyToMessage(ctx, msg, errorStr+": no active request to cancel")
+			return
+		}
+		match = func(e *DownloadQueueEntry) bool { return e.ID == id }
+	}
+
+	count, err := dlQueue.CancelEntries(msg.From.ID, admin, match)
+	if err != nil {
 		sendReplyToMessage(ctx, msg, errorStr+": "+err.Error())
+		return
 	}
+	if count > 1 {
+		sendReplyToMessage(ctx, msg, fmt.Sprintf("%s %d requests", canceledStr, count))
+	}
+}
+
+func handleCmdEDQueue(ctx context.Context, msg *models.Message) {
+	sendReplyToMessage(ctx, msg, dlQueue.GetQueueText(msg.From.ID, isAdmin(msg.From.ID)))
 }
 
 func handleCmdModels(ctx context.Context, msg *models.Message) {
@@ -179,7 +139,13 @@ func handleCmdModels(ctx context.Context, msg *models.Message) {
 			models = append(models, strings.TrimSuffix(fn, ext))
 		}
 	}
-	sendReplyToMessage(ctx, msg, "🧩 Available models: "+strings.Join(models, ", ")+". Default: "+params.DefaultModel)
+	text := "🧩 Available models: " + strings.Join(models, ", ") + ". Default: " + params.DefaultModel
+	for _, model := range models {
+		if cfg := getModelConfigText(model); cfg != "" {
+			text += "\n" + model + ": " + cfg
+		}
+	}
+	sendReplyToMessage(ctx, msg, text)
 }
 
 func handleCmdEmbeddings(ctx context.Context, msg *models.Message) {
@@ -206,7 +172,10 @@ func handleCmdHelp(ctx context.Context, msg *models.Message) {
 	sendReplyToMessage(ctx, msg, "🤖 Easy Diffusion Telegram Bot\n\n"+
 		"Available commands:\n\n"+
 		"!ed [prompt] - render prompt\n"+
-		"!edcancel - cancel current render\n"+
+		"!edanim [prompt] - render an animation, use -toseed, -toprompt or -anim:attr:from..to\n"+
+		"!edextend [prompt] - reply to a photo to extend it, use -dir:left/right/up/down and -px\n"+
+		"!edcancel [id|all] - cancel your current or given request, or reply to a request to cancel it\n"+
+		"!edqueue - list queued requests\n"+
 		"!edmodels - list available models\n"+
 		"!edembeddings - list available embeddings\n"+
 		"!edhelp - show this help\n\n"+
@@ -236,19 +205,31 @@ func telegramBotUpdateHandler(ctx context.Context, b *bot.Bot, update *models.Up
 
 	// Check if message is a command.
 	if update.Message.Text[0] == '/' || update.Message.Text[0] == '!' {
-		cmd := strings.Split(update.Message.Text, " ")[0]
+		cmd := update.Message.Text
+		if i := strings.IndexFunc(cmd, unicode.IsSpace); i >= 0 {
+			cmd = cmd[:i]
+		}
+		update.Message.Text = strings.TrimLeft(strings.TrimPrefix(update.Message.Text, cmd), " \t")
 		if strings.Contains(cmd, "@") {
 			cmd = strings.Split(cmd, "@")[0]
 		}
-		update.Message.Text = strings.TrimPrefix(update.Message.Text, cmd+" ")
 		cmd = cmd[1:] // Cutting the command character.
 		switch cmd {
 		case "ed":
-			handleCmdED(ctx, update.Message)
+			handleCmdED(ctx, update.Message, RenderModeImages)
+			return
+		case "edanim":
+			handleCmdED(ctx, update.Message, RenderModeAnim)
+			return
+		case "edextend":
+			handleCmdEDExtend(ctx, update.Message)
 			return
 		case "edcancel":
 			handleCmdEDCancel(ctx, update.Message)
 			return
+		case "edqueue":
+			handleCmdEDQueue(ctx, update.Message)
+			return
 		case "edmodels":
 			handleCmdModels(ctx, update.Message)
 			return
@@ -275,7 +256,7 @@ func telegramBotUpdateHandler(ctx context.Context, b *bot.Bot, update *models.Up
 	}
 
 	if update.Message.Chat.ID >= 0 { // From user?
-		handleCmdED(ctx, update.Message)
+		handleCmdED(ctx, update.Message, RenderModeImages)
 	}
 }
 
@@ -287,7 +268,8 @@ func main() {
 		os.Exit(1)
 	}
 
-	if !params.DelayedEDStart {
+	// If Easy Diffusion is already running, its version is checked at startup even with delayed start.
+	if !params.DelayedEDStart || isEasyDiffusionRunning() {
 		if err := startEasyDiffusionIfNeeded(); err != nil {
 			panic(err.Error())
 		}
@@ -309,12 +291,7 @@ func main() {
 		panic(fmt.Sprint("can't init telegram bot: ", err))
 	}
 
-	for _, chatID := range params.AdminUserIDs {
-		_, _ = telegramBot.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: chatID,
-			Text:   "🤖 Bot started",
-		})
-	}
+	sendMessageToAdmins(ctx, "🤖 Bot started")
 
 	telegramBot.Start(ctx)
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Per-model settings. The defaults are applied before the user's attributes, the overrides (VAE, VRAM usage
+// level, clip skip and refiner) are applied each time the model is set.
+type ModelConfig struct {
+	Aliases        []string `json:"aliases"`
+	Width          int      `json:"width"` // The native resolution is calculated from the width and height.
+	Height         int      `json:"height"`
+	Sampler        string   `json:"sampler"`
+	Steps          int      `json:"steps"`
+	GuidanceScale  float32  `json:"guidance_scale"`
+	NegativePrompt string   `json:"negative_prompt"`
+	VAE            string   `json:"vae"`
+	ClipSkip       *bool    `json:"clip_skip"`
+	VRAMUsageLevel string   `json:"vram_usage_level"`
+	Refiner        string   `json:"refiner"`
+}
+
+// Loads the model config file, which is a JSON object with model names as keys and ModelConfig values.
+func loadModelConfigs(path string) (configs map[string]ModelConfig, aliases map[string]string, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(b, &configs); err != nil {
+		return nil, nil, err
+	}
+
+	aliases = make(map[string]string)
+	for model, cfg := range configs {
+		if cfg.Width < 0 || cfg.Height < 0 || cfg.Steps < 0 || cfg.GuidanceScale < 0 {
+			return nil, nil, fmt.Errorf("model %s has negative values", model)
+		}
+		if (cfg.Width > 0) != (cfg.Height > 0) {
+			return nil, nil, fmt.Errorf("model %s should have both width and height set", model)
+		}
+		if cfg.VRAMUsageLevel != "" && !isValidVRAMUsageLevel(cfg.VRAMUsageLevel) {
+			return nil, nil, fmt.Errorf("model %s has invalid vram usage level: %s", model, cfg.VRAMUsageLevel)
+		}
+		cfg.Sampler = strings.ToLower(cfg.Sampler)
+		if cfg.Sampler != "" && !isValidSampler(cfg.Sampler) {
+			return nil, nil, fmt.Errorf("model %s has invalid sampler: %s", model, cfg.Sampler)
+		}
+		configs[model] = cfg
+		for _, alias := range cfg.Aliases {
+			alias = strings.ToLower(alias)
+			if otherModel, ok := aliases[alias]; ok {
+				return nil, nil, fmt.Errorf("alias %s is used for both %s and %s", alias, otherModel, model)
+			}
+			aliases[alias] = model
+		}
+	}
+
+	// Refiners can be given by their aliases too.
+	for model, cfg := range configs {
+		if refiner, ok := aliases[strings.ToLower(cfg.Refiner)]; ok {
+			cfg.Refiner = refiner
+			configs[model] = cfg
+		}
+	}
+	return
+}
+
+// Returns the model name for the given alias, or the given name if it's not an alias.
+func resolveModelAlias(name string) string {
+	if model, ok := params.ModelAliases[strings.ToLower(name)]; ok {
+		return model
+	}
+	return name
+}
+
+// Applies the configured defaults of the currently set model.
+func (p *RenderParams) applyModelDefaults() {
+	cfg, ok := params.ModelConfigs[p.ModelName]
+	if !ok {
+		return
+	}
+	if cfg.Width > 0 {
+		p.Width = cfg.Width
+		p.Height = cfg.Height
+	}
+	if cfg.Sampler != "" {
+		p.SamplerName = cfg.Sampler
+	}
+	if cfg.Steps > 0 {
+		p.NumInferenceSteps = cfg.Steps
+	}
+	if cfg.GuidanceScale > 0 {
+		p.GuidanceScale = cfg.GuidanceScale
+	}
+	if cfg.NegativePrompt != "" && p.NegativePrompt == "" {
+		p.NegativePrompt = cfg.NegativePrompt
+	}
+}
+
+// Returns the aliases and defaults of the model in a short, human readable form.
+func getModelConfigText(model string) string {
+	cfg, ok := params.ModelConfigs[model]
+	if !ok {
+		return ""
+	}
+	var res []string
+	if len(cfg.Aliases) > 0 {
+		aliases := append([]string{}, cfg.Aliases...)
+		sort.Strings(aliases)
+		res = append(res, "aliases: "+strings.Join(aliases, "/"))
+	}
+	if cfg.Width > 0 {
+		res = append(res, fmt.Sprintf("%dx%d", cfg.Width, cfg.Height))
+	}
+	if cfg.Sampler != "" {
+		res = append(res, cfg.Sampler)
+	}
+	if cfg.Steps > 0 {
+		res = append(res, fmt.Sprintf("👟%d", cfg.Steps))
+	}
+	if cfg.GuidanceScale > 0 {
+		res = append(res, fmt.Sprintf("🕹%.1f", cfg.GuidanceScale))
+	}
+	if cfg.VAE != "" {
+		res = append(res, "vae: "+cfg.VAE)
+	}
+	if cfg.ClipSkip != nil && *cfg.ClipSkip {
+		res = append(res, "✂️clipskip")
+	}
+	if cfg.VRAMUsageLevel != "" {
+		res = append(res, "vram: "+cfg.VRAMUsageLevel)
+	}
+	if cfg.Refiner != "" {
+		res = append(res, "🪄"+cfg.Refiner)
+	}
+	if cfg.NegativePrompt != "" {
+		res = append(res, "📍"+truncateString(cfg.NegativePrompt, 30))
+	}
+	return strings.Join(res, " ")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Sets the params for the test, they are restored when the test ends.
+func setTestParams(t *testing.T, p paramsType) {
+	orig := params
+	params = p
+	t.Cleanup(func() { params = orig })
+}
+
+func TestModelOverridesDontCarryOverInComparisons(t *testing.T) {
+	clipSkip := true
+	setTestParams(t, paramsType{
+		DefaultModel:          "base",
+		DefaultVRAMUsageLevel: "high",
+		BatchSize:             4,
+		DefaultRefinerSwitch:  0.8,
+		ModelConfigs: map[string]ModelConfig{
+			"base": {Refiner: "ref", ClipSkip: &clipSkip, VRAMUsageLevel: "low", VAE: "vae"},
+			"sd15": {},
+		},
+	})
+
+	p, err := getRenderParams("a cat -m:base,sd15", 0, RenderModeImages)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e := &DownloadQueueEntry{Params: p}
+
+	var refinerSteps int
+	for _, step := range e.getRenderSteps() {
+		switch step.Params.ModelName {
+		case "ref":
+			refinerSteps++
+		case "sd15":
+			if step.Params.RefinerModel != "" || step.Params.ClipSkip || step.Params.VRAMUsageLevel != "high" ||
+				step.Params.VAEModel != "" {
+				t.Errorf("base model's overrides carried over to sd15: refiner %q, clip skip %v, vram %s, vae %q",
+					step.Params.RefinerModel, step.Params.ClipSkip, step.Params.VRAMUsageLevel, step.Params.VAEModel)
+			}
+		case "base":
+			if !step.Params.ClipSkip || step.Params.VRAMUsageLevel != "low" {
+				t.Errorf("base model's overrides are not applied: clip skip %v, vram %s", step.Params.ClipSkip,
+					step.Params.VRAMUsageLevel)
+			}
+		}
+	}
+	if refinerSteps != 1 {
+		t.Errorf("expected 1 refiner step for the base model's cell, got %d", refinerSteps)
+	}
+}
+
+func TestModelOverridesKeepUserSetValues(t *testing.T) {
+	setTestParams(t, paramsType{
+		DefaultModel:          "base",
+		DefaultVRAMUsageLevel: "high",
+		BatchSize:             4,
+		AdminUserIDs:          []int64{1},
+		ModelConfigs: map[string]ModelConfig{
+			"base": {Refiner: "ref", VRAMUsageLevel: "low"},
+		},
+	})
+
+	p, err := getRenderParams("a cat -vram:balanced -refiner:none", 1, RenderModeImages)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.VRAMUsageLevel != "balanced" || p.RefinerModel != "" {
+		t.Errorf("user set values are overridden: vram %s, refiner %q", p.VRAMUsageLevel, p.RefinerModel)
+	}
+}
+
+func TestOOMRecoveryVRAMUsageIsKeptByModelOverrides(t *testing.T) {
+	setTestParams(t, paramsType{
+		DefaultModel:          "base",
+		DefaultVRAMUsageLevel: "high",
+		BatchSize:             4,
+		DefaultRefinerSwitch:  0.8,
+		OOMRecovery:           []string{"vram"},
+		MaxOutputs:            20,
+		ModelConfigs: map[string]ModelConfig{
+			"base": {Refiner: "ref"},
+		},
+	})
+
+	p, err := getRenderParams("a cat -o:1", 0, RenderModeImages)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e := &DownloadQueueEntry{Params: p}
+	e.reduceMemoryUsage()
+	e.reduceMemoryUsage()
+
+	for _, step := range e.getRenderSteps() {
+		if step.Params.VRAMUsageLevel != "low" {
+			t.Errorf("step with model %s has vram usage %s, expected low", step.Params.ModelName,
+				step.Params.VRAMUsageLevel)
+		}
+	}
+}
+
+func TestAnimRefiner(t *testing.T) {
+	setTestParams(t, paramsType{
+		DefaultModel: "base",
+		BatchSize:    4,
+		MaxOutputs:   20,
+		ModelConfigs: map[string]ModelConfig{
+			"base": {Refiner: "ref"},
+		},
+	})
+
+	p, err := getRenderParams("a cat -toseed:2", 0, RenderModeAnim)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.RefinerModel != "" {
+		t.Errorf("the model's default refiner is not cleared: %q", p.RefinerModel)
+	}
+
+	if _, err = getRenderParams("a cat -toseed:2 -refiner:ref", 0, RenderModeAnim); err == nil {
+		t.Error("expected an error for an explicit refiner")
+	}
+	if _, err = getRenderParams("a cat -toseed:2 -refiner:none", 0, RenderModeAnim); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtendRefiner(t *testing.T) {
+	setTestParams(t, paramsType{
+		DefaultModel: "base",
+		BatchSize:    4,
+		MaxOutputs:   20,
+		ModelConfigs: map[string]ModelConfig{
+			"base": {Refiner: "ref"},
+		},
+	})
+
+	p, err := getRenderParams("a cat -dir:left", 0, RenderModeExtend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.RefinerModel != "" {
+		t.Errorf("the model's default refiner is not cleared: %q", p.RefinerModel)
+	}
+
+	if _, err = getRenderParams("a cat -refiner:ref", 0, RenderModeExtend); err == nil {
+		t.Error("expected an error for an explicit refiner")
+	}
+}
+
+func TestLoadModelConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    bool
+	}{
+		{"valid", `{"m": {"aliases": ["a"], "sampler": "Euler_A", "vram_usage_level": "low", "refiner": "a"}}`, false},
+		{"invalid sampler", `{"m": {"sampler": "eulr"}}`, true},
+		{"invalid vram usage level", `{"m": {"vram_usage_level": "max"}}`, true},
+		{"missing height", `{"m": {"width": 512}}`, true},
+		{"duplicate alias", `{"m": {"aliases": ["a"]}, "n": {"aliases": ["A"]}}`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "models.json")
+			if err := os.WriteFile(path, []byte(test.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			configs, _, err := loadModelConfigs(path)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error result: %v", err)
+			}
+			if err == nil && (configs["m"].Sampler != "euler_a" || configs["m"].Refiner != "m") {
+				t.Errorf("sampler or refiner is not normalized: %+v", configs["m"])
+			}
+		})
+	}
+
+	if _, _, err := loadModelConfigs("models.json-example"); err != nil {
+		t.Errorf("can't load the example config: %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/exp/slices"
 )
@@ -21,10 +22,47 @@ type paramsType struct {
 	DelayedEDStart bool
 	DefaultModel   string
 	DefaultSampler string
+
+	RetryCount int
+	RetryDelay time.Duration
+
+	QueuedEntryExpiry time.Duration // Entries waiting longer than this are not rendered.
+
+	MaxOutputs int
+	BatchSize  int
+
+	OOMRecovery []string
+
+	ModelFallback bool
+
+	DefaultVRAMUsageLevel string
+	DefaultClipSkip       bool
+	RenderDevice          string
+
+	WildcardsPath string
+
+	DefaultHiresDenoise float32
+
+	DefaultRefinerSwitch float32
+
+	Scheduling        string // fifo, user or chat.
+	SchedulingWeights map[int64]float64
+
+	ModelConfigPath string
+	ModelConfigs    map[string]ModelConfig
+	ModelAliases    map[string]string // Lowercase alias -> model name.
 }
 
 var params paramsType
 
+func isValidVRAMUsageLevel(level string) bool {
+	switch level {
+	case "low", "balanced", "high":
+		return true
+	}
+	return false
+}
+
 func (p *paramsType) Init() error {
 	flag.StringVar(&p.BotToken, "bot-token", "", "telegram bot token")
 	flag.StringVar(&p.EasyDiffusionPath, "easy-diffusion-path", "", "path of the easy diffusion start script")
@@ -37,6 +75,26 @@ func (p *paramsType) Init() error {
 	flag.BoolVar(&p.DelayedEDStart, "delayed-ed-start", false, "start easy diffusion only when the first prompt arrives")
 	flag.StringVar(&p.DefaultModel, "default-model", "", "default model name")
 	flag.StringVar(&p.DefaultSampler, "default-sampler", "", "default sampler name")
+	flag.IntVar(&p.RetryCount, "retry-count", -1, "max. retry count for transient easy diffusion errors (default 5)")
+	flag.DurationVar(&p.RetryDelay, "retry-delay", 0, "initial delay between retries, doubled on each retry (default 1s)")
+	flag.DurationVar(&p.QueuedEntryExpiry, "queued-entry-expiry", 0, "requests waiting in the queue longer than this are dropped (default 1h)")
+	flag.IntVar(&p.MaxOutputs, "max-outputs", 0, "max. count of output images per request (default 20)")
+	flag.IntVar(&p.BatchSize, "batch-size", 0, "max. count of images rendered at once, images are sent after each batch (default 4)")
+	var oomRecovery string
+	flag.StringVar(&oomRecovery, "oom-recovery", "", "out of memory recovery steps in order, \"none\" disables (default \"vram,outputs,size\")")
+	flag.BoolVar(&p.ModelFallback, "model-fallback", false, "render with the default model if the requested model fails to load")
+	flag.StringVar(&p.DefaultVRAMUsageLevel, "default-vram-usage-level", "", "default vram usage level: low, balanced or high (default high)")
+	flag.BoolVar(&p.DefaultClipSkip, "default-clip-skip", false, "use clip skip by default")
+	flag.StringVar(&p.RenderDevice, "render-device", "", "easy diffusion render device")
+	flag.StringVar(&p.WildcardsPath, "wildcards-path", "", "path of the directory containing the wildcard files")
+	var defaultHiresDenoise float64
+	flag.Float64Var(&defaultHiresDenoise, "default-hires-denoise", 0, "default denoise strength of the hires fix second pass (default 0.5)")
+	var defaultRefinerSwitch float64
+	flag.Float64Var(&defaultRefinerSwitch, "default-refiner-switch", 0, "default fraction of steps after which the refiner takes over (default 0.8)")
+	flag.StringVar(&p.ModelConfigPath, "model-config", "", "path of the JSON file containing model aliases and per-model settings")
+	flag.StringVar(&p.Scheduling, "scheduling", "", "queue scheduling: fifo, user (round-robin between users) or chat (round-robin between chats) (default user)")
+	var schedulingWeights string
+	flag.StringVar(&schedulingWeights, "scheduling-weights", "", "per-user or per-chat scheduling weights in id:weight format")
 	flag.Parse()
 
 	if p.BotToken == "" {
@@ -110,13 +168,211 @@ func (p *paramsType) Init() error {
 		}
 	}
 
+	s = os.Getenv("MODEL_FALLBACK")
+	if s != "" {
+		if s == "0" {
+			p.ModelFallback = false
+		} else {
+			p.ModelFallback = true
+		}
+	}
+
+	if p.DefaultVRAMUsageLevel == "" {
+		p.DefaultVRAMUsageLevel = os.Getenv("DEFAULT_VRAM_USAGE_LEVEL")
+	}
+	if p.DefaultVRAMUsageLevel == "" {
+		p.DefaultVRAMUsageLevel = "high"
+	}
+	if !isValidVRAMUsageLevel(p.DefaultVRAMUsageLevel) {
+		return fmt.Errorf("invalid default vram usage level: " + p.DefaultVRAMUsageLevel)
+	}
+
+	s = os.Getenv("DEFAULT_CLIP_SKIP")
+	if s != "" {
+		if s == "0" {
+			p.DefaultClipSkip = false
+		} else {
+			p.DefaultClipSkip = true
+		}
+	}
+
+	if p.RenderDevice == "" {
+		p.RenderDevice = os.Getenv("RENDER_DEVICE")
+	}
+
+	if p.WildcardsPath == "" {
+		p.WildcardsPath = os.Getenv("WILDCARDS_PATH")
+	}
+
+	if defaultHiresDenoise == 0 {
+		s = os.Getenv("DEFAULT_HIRES_DENOISE")
+		if s != "" {
+			var err error
+			defaultHiresDenoise, err = strconv.ParseFloat(s, 32)
+			if err != nil {
+				return fmt.Errorf("invalid default hires denoise: " + s)
+			}
+		} else {
+			defaultHiresDenoise = 0.5
+		}
+	}
+	if defaultHiresDenoise <= 0 || defaultHiresDenoise > 1 {
+		return fmt.Errorf("default hires denoise should be between 0 and 1")
+	}
+	p.DefaultHiresDenoise = float32(defaultHiresDenoise)
+
+	if defaultRefinerSwitch == 0 {
+		s = os.Getenv("DEFAULT_REFINER_SWITCH")
+		if s != "" {
+			var err error
+			defaultRefinerSwitch, err = strconv.ParseFloat(s, 32)
+			if err != nil {
+				return fmt.Errorf("invalid default refiner switch: " + s)
+			}
+		} else {
+			defaultRefinerSwitch = 0.8
+		}
+	}
+	if defaultRefinerSwitch <= 0 || defaultRefinerSwitch >= 1 {
+		return fmt.Errorf("default refiner switch should be between 0 and 1")
+	}
+	p.DefaultRefinerSwitch = float32(defaultRefinerSwitch)
+
+	if p.ModelConfigPath == "" {
+		p.ModelConfigPath = os.Getenv("MODEL_CONFIG")
+	}
+	if p.ModelConfigPath != "" {
+		var err error
+		p.ModelConfigs, p.ModelAliases, err = loadModelConfigs(p.ModelConfigPath)
+		if err != nil {
+			return fmt.Errorf("can't load model config: %w", err)
+		}
+	}
+
 	if p.DefaultModel == "" {
 		p.DefaultModel = os.Getenv("DEFAULT_MODEL")
 	}
+	p.DefaultModel = resolveModelAlias(p.DefaultModel)
 
 	if p.DefaultSampler == "" {
 		p.DefaultSampler = os.Getenv("DEFAULT_SAMPLER")
 	}
 
+	if p.RetryCount < 0 {
+		s = os.Getenv("RETRY_COUNT")
+		if s != "" {
+			var err error
+			p.RetryCount, err = strconv.Atoi(s)
+			if err != nil || p.RetryCount < 0 {
+				return fmt.Errorf("invalid retry count: " + s)
+			}
+		} else {
+			p.RetryCount = 5
+		}
+	}
+
+	if p.RetryDelay <= 0 {
+		s = os.Getenv("RETRY_DELAY")
+		if s != "" {
+			var err error
+			p.RetryDelay, err = time.ParseDuration(s)
+			if err != nil || p.RetryDelay <= 0 {
+				return fmt.Errorf("invalid retry delay: " + s)
+			}
+		} else {
+			p.RetryDelay = time.Second
+		}
+	}
+
+	if p.QueuedEntryExpiry <= 0 {
+		s = os.Getenv("QUEUED_ENTRY_EXPIRY")
+		if s != "" {
+			var err error
+			p.QueuedEntryExpiry, err = time.ParseDuration(s)
+			if err != nil || p.QueuedEntryExpiry <= 0 {
+				return fmt.Errorf("invalid queued entry expiry: " + s)
+			}
+		} else {
+			p.QueuedEntryExpiry = time.Hour
+		}
+	}
+
+	if p.MaxOutputs <= 0 {
+		s = os.Getenv("MAX_OUTPUTS")
+		if s != "" {
+			var err error
+			p.MaxOutputs, err = strconv.Atoi(s)
+			if err != nil || p.MaxOutputs <= 0 {
+				return fmt.Errorf("invalid max outputs: " + s)
+			}
+		} else {
+			p.MaxOutputs = 20
+		}
+	}
+
+	if p.BatchSize <= 0 {
+		s = os.Getenv("BATCH_SIZE")
+		if s != "" {
+			var err error
+			p.BatchSize, err = strconv.Atoi(s)
+			if err != nil || p.BatchSize <= 0 {
+				return fmt.Errorf("invalid batch size: " + s)
+			}
+		} else {
+			p.BatchSize = 4
+		}
+	}
+
+	if p.Scheduling == "" {
+		p.Scheduling = os.Getenv("SCHEDULING")
+	}
+	switch p.Scheduling {
+	case "":
+		p.Scheduling = "user"
+	case "fifo", "user", "chat":
+	default:
+		return fmt.Errorf("invalid scheduling: " + p.Scheduling)
+	}
+
+	if schedulingWeights == "" {
+		schedulingWeights = os.Getenv("SCHEDULING_WEIGHTS")
+	}
+	p.SchedulingWeights = make(map[int64]float64)
+	sa = strings.Split(schedulingWeights, ",")
+	for _, idWeight := range sa {
+		if idWeight == "" {
+			continue
+		}
+		idStr, weightStr, ok := strings.Cut(idWeight, ":")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if !ok || err != nil {
+			return fmt.Errorf("scheduling weights contains invalid entry: " + idWeight)
+		}
+		weight, err := strconv.ParseFloat(weightStr, 64)
+		if err != nil || weight <= 0 {
+			return fmt.Errorf("scheduling weights contains invalid entry: " + idWeight)
+		}
+		p.SchedulingWeights[id] = weight
+	}
+
+	if oomRecovery == "" {
+		oomRecovery = os.Getenv("OOM_RECOVERY")
+	}
+	if oomRecovery == "" {
+		oomRecovery = "vram,outputs,size"
+	}
+	if oomRecovery != "none" {
+		sa = strings.Split(oomRecovery, ",")
+		for _, step := range sa {
+			step = strings.TrimSpace(step)
+			switch step {
+			case "vram", "outputs", "size":
+				p.OOMRecovery = append(p.OOMRecovery, step)
+			default:
+				return fmt.Errorf("invalid out of memory recovery step: " + step)
+			}
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type PromptAttr struct {
+	Name  string // Lowercase, without the leading dashes.
+	Value string
+}
+
+type ParsedPrompt struct {
+	// The prompt line with the attributes, without the negative prompt.
+	RawPrompt      string
+	Prompt         string
+	NegativePrompt string
+	Attrs          []PromptAttr
+}
+
+// Parses prompts with attributes in -attr:value, -attr:"quoted value", --attr value and --attr:value forms.
+// The negative prompt can be given after a || separator, after the negative prompt attribute, or in the lines
+// following the first line.
+type PromptParser struct {
+	// These attributes don't take a value in the --attr form.
+	FlagAttrs []string
+	// The rest of the line after this attribute is the negative prompt.
+	NegativePromptAttr string
+}
+
+func (pp *PromptParser) isFlagAttr(name string) bool {
+	for _, a := range pp.FlagAttrs {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isAttrNameChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func getClosingQuote(r rune) (rune, bool) {
+	switch r {
+	case '"':
+		return '"', true
+	case '“': // Phone keyboards often use smart quotes.
+		return '”', true
+	}
+	return 0, false
+}
+
+// Returns true if the negative prompt separator (||) is at pos.
+func isNegativePromptSeparator(text []rune, pos int) bool {
+	return pos+1 < len(text) && text[pos] == '|' && text[pos+1] == '|'
+}
+
+// Returns the end of the unquoted word starting at pos.
+func getWordEnd(text []rune, pos int) int {
+	for pos < len(text) && !unicode.IsSpace(text[pos]) && !isNegativePromptSeparator(text, pos) {
+		pos++
+	}
+	return pos
+}
+
+// Reads a value starting at pos, which is either quoted or ends at the next whitespace or negative prompt
+// separator.
+func readPromptAttrValue(text []rune, pos int) (value string, newPos int, err error) {
+	if pos < len(text) {
+		if closingQuote, ok := getClosingQuote(text[pos]); ok {
+			for i := pos + 1; i < len(text); i++ {
+				if text[i] == closingQuote {
+					return string(text[pos+1 : i]), i + 1, nil
+				}
+			}
+			return "", pos, fmt.Errorf("unclosed quote")
+		}
+	}
+	end := getWordEnd(text, pos)
+	return string(text[pos:end]), end, nil
+}
+
+func (pp *PromptParser) parseLine(line string, res *ParsedPrompt) error {
+	text := []rune(line)
+	var words []string
+	pos := 0
+	for {
+		for pos < len(text) && unicode.IsSpace(text[pos]) {
+			pos++
+		}
+		if pos >= len(text) {
+			break
+		}
+		if isNegativePromptSeparator(text, pos) { // Separators inside quoted values are skipped by readPromptAttrValue().
+			res.NegativePrompt = strings.Join(strings.Fields(string(text[pos+2:])), " ")
+			text = text[:pos]
+			break
+		}
+
+		attrStart := pos
+		dashes := 0
+		for pos+dashes < len(text) && dashes < 2 && text[pos+dashes] == '-' {
+			dashes++
+		}
+		if dashes == 0 || pos+dashes >= len(text) || !unicode.IsLetter(text[pos+dashes]) { // Prompt word?
+			start := pos
+			pos = getWordEnd(text, pos)
+			words = append(words, string(text[start:pos]))
+			continue
+		}
+
+		pos += dashes
+		start := pos
+		for pos < len(text) && isAttrNameChar(text[pos]) {
+			pos++
+		}
+		attr := PromptAttr{Name: strings.ToLower(string(text[start:pos]))}
+
+		if attr.Name == pp.NegativePromptAttr && pp.NegativePromptAttr != "" {
+			if pos < len(text) && text[pos] == ':' {
+				pos++
+			}
+			res.NegativePrompt = strings.Join(strings.Fields(string(text[pos:])), " ")
+			text = text[:attrStart]
+			break
+		}
+
+		var err error
+		switch {
+		case pos < len(text) && text[pos] == ':':
+			attr.Value, pos, err = readPromptAttrValue(text, pos+1)
+		case pos < len(text) && !unicode.IsSpace(text[pos]) && !isNegativePromptSeparator(text, pos):
+			// Invalid character in the attribute name, the whole word is used as the name so it can be reported.
+			pos = getWordEnd(text, pos)
+			attr.Name = strings.ToLower(string(text[start:pos]))
+		case dashes == 2 && !pp.isFlagAttr(attr.Name):
+			for pos < len(text) && unicode.IsSpace(text[pos]) {
+				pos++
+			}
+			if pos >= len(text) || isNegativePromptSeparator(text, pos) {
+				return fmt.Errorf("missing value for attribute %s", attr.Name)
+			}
+			attr.Value, pos, err = readPromptAttrValue(text, pos)
+		}
+		if err != nil {
+			return fmt.Errorf("attribute %s: %w", attr.Name, err)
+		}
+		res.Attrs = append(res.Attrs, attr)
+	}
+	res.Prompt = strings.Join(words, " ")
+	res.RawPrompt = strings.TrimSpace(string(text))
+	return nil
+}
+
+// Parses the prompt from the first line of the text, and the negative prompt from the first line's inline
+// negative prompt and the following lines.
+func (pp *PromptParser) Parse(text string) (res ParsedPrompt, err error) {
+	promptLine, negativeLines, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	if err = pp.parseLine(promptLine, &res); err != nil {
+		return
+	}
+	res.NegativePrompt = strings.Join(strings.Fields(res.NegativePrompt+" "+negativeLines), " ")
+	return
+}
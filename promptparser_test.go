@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPromptParserParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		prompt   string
+		negative string
+		attrs    []PromptAttr
+		err      string
+	}{
+		{
+			name:   "spaces and tabs",
+			text:   "  a   cat \t on\t\ta  mat  ",
+			prompt: "a cat on a mat",
+		},
+		{
+			name:   "colon value",
+			text:   "a cat -seed:123",
+			prompt: "a cat",
+			attrs:  []PromptAttr{{Name: "seed", Value: "123"}},
+		},
+		{
+			name:   "quoted value",
+			text:   `a cat -model:"my model" on a mat`,
+			prompt: "a cat on a mat",
+			attrs:  []PromptAttr{{Name: "model", Value: "my model"}},
+		},
+		{
+			name:   "smart quoted value",
+			text:   "a cat -model:“my model”",
+			prompt: "a cat",
+			attrs:  []PromptAttr{{Name: "model", Value: "my model"}},
+		},
+		{
+			name:   "double dash value",
+			text:   "a cat --steps 30 on a mat",
+			prompt: "a cat on a mat",
+			attrs:  []PromptAttr{{Name: "steps", Value: "30"}},
+		},
+		{
+			name:   "double dash colon value",
+			text:   "--Steps:30 a cat",
+			prompt: "a cat",
+			attrs:  []PromptAttr{{Name: "steps", Value: "30"}},
+		},
+		{
+			name:   "flag attr",
+			text:   "a cat --clipskip dog",
+			prompt: "a cat dog",
+			attrs:  []PromptAttr{{Name: "clipskip"}},
+		},
+		{
+			name:   "bare dashes",
+			text:   "a cat - a dog -- a mouse -5",
+			prompt: "a cat - a dog -- a mouse -5",
+		},
+		{
+			name:   "invalid attr name",
+			text:   "a cat -foo! -seed:1",
+			prompt: "a cat",
+			attrs:  []PromptAttr{{Name: "foo!"}, {Name: "seed", Value: "1"}},
+		},
+		{
+			name:     "inline negative prompt",
+			text:     "a cat -seed:1 || dog,  mouse",
+			prompt:   "a cat",
+			negative: "dog, mouse",
+			attrs:    []PromptAttr{{Name: "seed", Value: "1"}},
+		},
+		{
+			name:     "inline negative prompt without spaces",
+			text:     "a cat -seed:1||dog",
+			prompt:   "a cat",
+			negative: "dog",
+			attrs:    []PromptAttr{{Name: "seed", Value: "1"}},
+		},
+		{
+			name:     "separator in quoted value",
+			text:     `a cat -toprompt:"a dog || blurry" || mouse`,
+			prompt:   "a cat",
+			negative: "mouse",
+			attrs:    []PromptAttr{{Name: "toprompt", Value: "a dog || blurry"}},
+		},
+		{
+			name:     "negative prompt attr",
+			text:     "a cat -neg: dog  mouse",
+			prompt:   "a cat",
+			negative: "dog mouse",
+		},
+		{
+			name:     "negative prompt lines",
+			text:     "a cat\ndog\nmouse",
+			prompt:   "a cat",
+			negative: "dog mouse",
+		},
+		{
+			name: "unclosed quote",
+			text: `a cat -model:"my model`,
+			err:  "attribute model: unclosed quote",
+		},
+		{
+			name: "missing value",
+			text: "a cat --steps",
+			err:  "missing value for attribute steps",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := promptParser.Parse(test.text)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Prompt != test.prompt {
+				t.Errorf("prompt: expected %q, got %q", test.prompt, res.Prompt)
+			}
+			if res.NegativePrompt != test.negative {
+				t.Errorf("negative prompt: expected %q, got %q", test.negative, res.NegativePrompt)
+			}
+			if !reflect.DeepEqual(res.Attrs, test.attrs) {
+				t.Errorf("attrs: expected %v, got %v", test.attrs, res.Attrs)
+			}
+		})
+	}
+}
+
+func TestGetRenderParamsReportsAllInvalidAttrs(t *testing.T) {
+	_, err := getRenderParams("a cat -foo! -bar:1 -seed:1", 0, RenderModeImages)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, attr := range []string{"foo!", "bar"} {
+		if !strings.Contains(err.Error(), "invalid attribute "+attr) {
+			t.Errorf("expected error to contain attribute %s, got %q", attr, err)
+		}
+	}
+}
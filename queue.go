@@ -3,11 +3,17 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"math"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,21 +27,110 @@ const progressBarLength = 20
 const uploadingStr = "☁ ️ Uploading..."
 const errorStr = "❌ Error"
 const canceledStr = "❌ Canceled"
+const expiredStr = "⌛ Expired, waited too long in the queue"
 const restartStr = "⚠️ Easy Diffusion is not running, starting, please wait..."
 const restartFailedStr = "☠️ Easy Diffusion start failed, please restart the bot"
+const retryingStr = "🔁 Retrying"
+const outOfMemoryStr = "⚠️ Out of memory, retrying with"
+const modelFallbackStr = "⚠️ Model failed to load, falling back to"
 
-const processTimeout = 3 * time.Minute
+const processTimeout = 3 * time.Minute // For each render call of an entry.
 const groupChatProgressUpdateInterval = 3 * time.Second
 const privateChatProgressUpdateInterval = 500 * time.Millisecond
+const defaultEntryDuration = 30 * time.Second
+const maxQueueListLength = 20
+const maxFinishedEntries = 20 // Count of finished entries kept for /edqueue and /edcancel.
+const maxFinishedListLength = 5
+const oomRecoveryMinImageSize = 256
+const maxAlbumSize = 10
+const maxCaptionLength = 1024
+
+// A single render call of a queue entry.
+type RenderStep struct {
+	Params RenderParams
+	// Added to the caption of the images rendered in this step.
+	Caption string
+	// The image rendered in the previous step is used as the init image.
+	UsePrevImage bool
+	// The image rendered in the first step is used as the init image.
+	UseFirstImage bool
+	// Images of intermediate steps are not sent.
+	Intermediate bool
+	// The images rendered so far are sent after this step.
+	Deliver bool
+}
+
+type EntryState int
+
+const (
+	EntryStateQueued EntryState = iota
+	EntryStateStarting
+	EntryStateRendering
+	EntryStateUploading
+	EntryStateDone
+	EntryStateFailed
+	EntryStateCanceled
+	EntryStateExpired
+)
+
+func (s EntryState) String() string {
+	switch s {
+	case EntryStateQueued:
+		return "queued"
+	case EntryStateStarting:
+		return "starting"
+	case EntryStateRendering:
+		return "rendering"
+	case EntryStateUploading:
+		return "uploading"
+	case EntryStateDone:
+		return "done"
+	case EntryStateFailed:
+		return "failed"
+	case EntryStateCanceled:
+		return "canceled"
+	case EntryStateExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// Returns true if the entry is finished and won't change anymore.
+func (s EntryState) IsFinal() bool {
+	return s >= EntryStateDone
+}
 
 type DownloadQueueEntry struct {
+	// The ID and the state fields are accessed with the queue's mutex locked.
+	ID         uint64
+	State      EntryState
+	CreatedAt  time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+
 	Params RenderParams
+	// The render params text when the entry was added, it doesn't change during processing.
+	ParamsSummary string
 
 	TaskID           uint64
+	StreamPath       string
 	RenderParamsText string
+	OOMChanges       []string
+	FallbackFrom     string
+	// Count of output images already sent, they are not rendered again on retries.
+	DeliveredOutputs int
 
+	// Replies can be sent from multiple goroutines, the mutex serializes them. It can be locked before the
+	// queue's mutex, but not after it.
+	replyMutex   sync.Mutex
 	ReplyMessage *models.Message
 	Message      *models.Message
+	// The ID of the reply message, it can be read from other goroutines.
+	replyMessageID atomic.Int64
+
+	// Scheduling fields, accessed with the queue's mutex locked.
+	virtualTime   float64
+	queuePosition int // The last sent queue position.
 }
 
 func (e *DownloadQueueEntry) checkWaitError(err error) time.Duration {
@@ -53,8 +148,18 @@ func (e *DownloadQueueEntry) checkWaitError(err error) time.Duration {
 }
 
 func (e *DownloadQueueEntry) sendReply(ctx context.Context, s string) {
+	e.replyMutex.Lock()
+	defer e.replyMutex.Unlock()
+	e.sendReplyLocked(ctx, s)
+}
+
+// Sends or edits the reply message. The entry's reply mutex should be locked.
+func (e *DownloadQueueEntry) sendReplyLocked(ctx context.Context, s string) {
 	if e.ReplyMessage == nil {
 		e.ReplyMessage = sendReplyToMessage(ctx, e.Message, s)
+		if e.ReplyMessage != nil {
+			e.replyMessageID.Store(int64(e.ReplyMessage.ID))
+		}
 	} else if e.ReplyMessage.Text != s {
 		e.ReplyMessage.Text = s
 		_, err := telegramBot.EditMessageText(ctx, &bot.EditMessageTextParams{
@@ -72,26 +177,58 @@ func (e *DownloadQueueEntry) sendReply(ctx context.Context, s string) {
 	}
 }
 
-func (e *DownloadQueueEntry) sendImages(ctx context.Context, imgs [][]byte, retryAllowed bool) {
+// Returns the HTML caption of an image. The first image's caption contains the prompt and the render params,
+// the given caption is added to it.
+func (e *DownloadQueueEntry) getImageCaption(first bool, caption string) string {
+	var c, negText string
+	if first {
+		c = e.Params.OrigPrompt + " (" + e.RenderParamsText + ")"
+		if e.Params.NegativePrompt != "" {
+			negText = truncateString("📍"+e.Params.NegativePrompt, maxCaptionLength/2)
+		}
+	}
+	if caption != "" {
+		c = strings.TrimSpace(c + "\n" + caption)
+	}
+	c = html.EscapeString(truncateString(c, maxCaptionLength-len(negText)-1))
+	if negText != "" { // The full negative prompt is shown in an expandable quote.
+		c += "\n<blockquote expandable>" + html.EscapeString(negText) + "</blockquote>"
+	}
+	return c
+}
+
+// Sends the images in albums. The first image's caption contains the prompt and the render params, the
+// given captions are added to each image's caption.
+func (e *DownloadQueueEntry) sendImages(ctx context.Context, imgs [][]byte, captions []string, retryAllowed bool) {
 	if len(imgs) == 0 {
 		return
 	}
 
 	var media []models.InputMedia
 	for i := range imgs {
-		var c string
-		if i == 0 {
-			c = e.Params.OrigPrompt + " (" + e.RenderParamsText + ")"
-			if len(c) > 1024 {
-				c = c[:1021] + "..."
-			}
+		var caption string
+		if i < len(captions) {
+			caption = captions[i]
 		}
 		media = append(media, &models.InputMediaPhoto{
 			Media:           fmt.Sprintf("attach://ed-image-%x-%d-%d.jpg", e.Params.Seed, e.TaskID, i),
 			MediaAttachment: bytes.NewReader(imgs[i]),
-			Caption:         c,
+			Caption:         e.getImageCaption(i == 0, caption),
+			ParseMode:       models.ParseModeHTML,
 		})
 	}
+
+	for len(media) > 0 {
+		chunkLen := len(media)
+		if chunkLen > maxAlbumSize {
+			chunkLen = maxAlbumSize
+		}
+		e.sendMediaGroup(ctx, media[:chunkLen], retryAllowed)
+		media = media[chunkLen:]
+	}
+}
+
+func (e *DownloadQueueEntry) sendMediaGroup(ctx context.Context, media []models.InputMedia, retryAllowed bool) {
 	params := &bot.SendMediaGroupParams{
 		ChatID:           e.Message.Chat.ID,
 		ReplyToMessageID: e.Message.ID,
@@ -109,13 +246,85 @@ func (e *DownloadQueueEntry) sendImages(ctx context.Context, imgs [][]byte, retr
 		if retryAfter > 0 {
 			fmt.Println("  retrying after", retryAfter, "...")
 			time.Sleep(retryAfter)
-			e.sendImages(ctx, imgs, false)
+			e.sendMediaGroup(ctx, media, false)
 			return
 		}
 	}
 }
 
+func (e *DownloadQueueEntry) sendAnimation(ctx context.Context, anim []byte, retryAllowed bool) {
+	_, err := telegramBot.SendAnimation(ctx, &bot.SendAnimationParams{
+		ChatID:           e.Message.Chat.ID,
+		ReplyToMessageID: e.Message.ID,
+		Animation: &models.InputFileUpload{
+			Filename: fmt.Sprintf("ed-anim-%x-%d.gif", e.Params.Seed, e.TaskID),
+			Data:     bytes.NewReader(anim),
+		},
+		Caption:   e.getImageCaption(true, ""),
+		ParseMode: models.ParseModeHTML,
+	})
+	if err != nil {
+		fmt.Println("  send animation error:", err)
+
+		if !retryAllowed {
+			return
+		}
+
+		retryAfter := e.checkWaitError(err)
+		if retryAfter > 0 {
+			fmt.Println("  retrying after", retryAfter, "...")
+			time.Sleep(retryAfter)
+			e.sendAnimation(ctx, anim, false)
+			return
+		}
+	}
+}
+
+// Changes the render params to use less memory according to the out of memory recovery policy.
+// Returns the description of the change, or an empty string if nothing can be reduced anymore.
+func (e *DownloadQueueEntry) reduceMemoryUsage() string {
+	for _, step := range params.OOMRecovery {
+		switch step {
+		case "vram":
+			switch e.Params.VRAMUsageLevel {
+			case "high":
+				e.Params.VRAMUsageLevel = "balanced"
+			case "balanced":
+				e.Params.VRAMUsageLevel = "low"
+			default:
+				continue
+			}
+			e.Params.VRAMUsageLevelSet = true // Per-model overrides of later steps shouldn't raise it again.
+			return "VRAM usage " + e.Params.VRAMUsageLevel
+		case "outputs":
+			batchSize := e.Params.BatchSize
+			if e.Params.NumOutputs < batchSize {
+				batchSize = e.Params.NumOutputs
+			}
+			// With img2img passes each output is already rendered separately.
+			if batchSize <= 1 || e.Params.HiresFactor > 1 || e.Params.RefinerModel != "" {
+				continue
+			}
+			e.Params.BatchSize = (batchSize + 1) / 2
+			return fmt.Sprint("batch size ", e.Params.BatchSize)
+		case "size":
+			width := e.Params.Width * 3 / 4 / 64 * 64
+			height := e.Params.Height * 3 / 4 / 64 * 64
+			if width < oomRecoveryMinImageSize || height < oomRecoveryMinImageSize {
+				continue
+			}
+			e.Params.Width = width
+			e.Params.Height = height
+			return fmt.Sprintf("size %dx%d", width, height)
+		}
+	}
+	return ""
+}
+
 func (e *DownloadQueueEntry) deleteReply(ctx context.Context) {
+	e.replyMutex.Lock()
+	defer e.replyMutex.Unlock()
+
 	if e.ReplyMessage == nil {
 		return
 	}
@@ -126,64 +335,302 @@ func (e *DownloadQueueEntry) deleteReply(ctx context.Context) {
 	})
 }
 
-type DownloadQueueCurrentEntry struct {
-	canceled  bool
-	ctxCancel context.CancelFunc
-}
-
 type DownloadQueue struct {
-	mutex          sync.Mutex
-	ctx            context.Context
-	entries        []DownloadQueueEntry
-	processReqChan chan bool
+	mutex   sync.Mutex
+	ctx     context.Context
+	entries []*DownloadQueueEntry // Queued and currently processed entries.
+	// The last finished entries, the newest is the last.
+	finishedEntries []*DownloadQueueEntry
+	lastEntryID     uint64
+	processReqChan  chan bool
+	// Moving average of the processing time of the entries, used for estimating start times.
+	avgEntryDuration time.Duration
+
+	virtualTime      float64
+	lastVirtualTimes map[int64]float64 // The virtual time of the last entry of each user or chat.
 
-	currentEntry DownloadQueueCurrentEntry
+	currentEntry     *DownloadQueueEntry
+	currentCtxCancel context.CancelFunc
+	currentCanceled  bool
 }
 
 func (q *DownloadQueue) Add(params RenderParams, message *models.Message) {
 	q.mutex.Lock()
 
-	newEntry := DownloadQueueEntry{
-		Params:  params,
-		Message: message,
-	}
-
-	if len(q.entries) > 0 {
-		fmt.Println("  queueing request at position #", len(q.entries))
-		newEntry.sendReply(q.ctx, q.getQueuePositionString(len(q.entries)))
+	q.lastEntryID++
+	newEntry := &DownloadQueueEntry{
+		ID:        q.lastEntryID,
+		State:     EntryStateQueued,
+		CreatedAt: time.Now(),
+		Params:    params,
+		Message:   message,
 	}
+	newEntry.updateRenderParamsText()
+	newEntry.ParamsSummary = newEntry.RenderParamsText
 
+	q.scheduleEntry(newEntry)
 	q.entries = append(q.entries, newEntry)
+
+	// If there's no processed entry, the new one will be started right away.
+	var updates []queuePositionUpdate
+	if q.currentEntry != nil {
+		updates = q.updateQueuePositions()
+	}
 	q.mutex.Unlock()
 
+	q.sendQueuePositionUpdates(updates)
+
 	select {
 	case q.processReqChan <- true:
 	default:
 	}
 }
 
-func (q *DownloadQueue) CancelCurrentEntry(ctx context.Context) (err error) {
+// Returns true if the message is the entry's request or the bot's reply to it.
+func (e *DownloadQueueEntry) isMessageOf(msg *models.Message) bool {
+	if msg.Chat.ID != e.Message.Chat.ID {
+		return false
+	}
+	return msg.ID == e.Message.ID || int64(msg.ID) == e.replyMessageID.Load()
+}
+
+// Returns the ID of the entry which is canceled if no entry is given: the user's processed or last queued entry.
+// For admins it's the currently processed entry.
+func (q *DownloadQueue) GetDefaultCancelEntryID(userID int64, admin bool) (id uint64, ok bool) {
 	q.mutex.Lock()
-	if len(q.entries) > 0 {
-		q.currentEntry.canceled = true
-		q.currentEntry.ctxCancel()
-	} else {
-		fmt.Println("  no active request to cancel")
-		err = fmt.Errorf("no active request to cancel")
+	defer q.mutex.Unlock()
+
+	if admin && q.currentEntry != nil {
+		return q.currentEntry.ID, true
+	}
+	for _, e := range q.entries {
+		if e.Message.From.ID != userID {
+			continue
+		}
+		if e == q.currentEntry {
+			return e.ID, true
+		}
+		id, ok = e.ID, true
 	}
-	q.mutex.Unlock()
 	return
 }
 
-func (q *DownloadQueue) getQueuePositionString(pos int) string {
-	return "👨‍👦‍👦 Request queued at position #" + fmt.Sprint(pos)
+// Cancels the entries for which match returns true. Non-admin users can only cancel their own entries.
+// Queued entries are removed from the queue, so they never get to Easy Diffusion.
+func (q *DownloadQueue) CancelEntries(userID int64, admin bool, match func(e *DownloadQueueEntry) bool) (count int, err error) {
+	var removed []*DownloadQueueEntry
+	var denied bool
+
+	q.mutex.Lock()
+	for _, e := range append([]*DownloadQueueEntry{}, q.entries...) {
+		if !match(e) {
+			continue
+		}
+		if !admin && e.Message.From.ID != userID {
+			denied = true
+			continue
+		}
+		count++
+
+		if e == q.currentEntry { // The processor sends the reply and sets the state.
+			q.currentCanceled = true
+			q.currentCtxCancel()
+			continue
+		}
+		q.finishEntry(e, EntryStateCanceled)
+		removed = append(removed, e)
+	}
+	var updates []queuePositionUpdate
+	if len(removed) > 0 {
+		updates = q.updateQueuePositions()
+	}
+	var finished *DownloadQueueEntry
+	if count == 0 && !denied {
+		for _, e := range q.finishedEntries {
+			if match(e) {
+				finished = e
+			}
+		}
+	}
+	q.mutex.Unlock()
+
+	for _, e := range removed {
+		fmt.Println("  request #", e.ID, "canceled while queued")
+		e.sendReply(q.ctx, canceledStr)
+	}
+	q.sendQueuePositionUpdates(updates)
+
+	if count == 0 {
+		if denied {
+			return 0, fmt.Errorf("only admins can cancel other users' requests")
+		}
+		if finished != nil {
+			return 0, fmt.Errorf("request #%d is already %s", finished.ID, finished.State)
+		}
+		fmt.Println("  no matching request to cancel")
+		return 0, fmt.Errorf("no matching request to cancel")
+	}
+	return count, nil
+}
+
+// Sets the state of the entry and updates its timestamps.
+func (q *DownloadQueue) setEntryState(qEntry *DownloadQueueEntry, state EntryState) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.updateEntryState(qEntry, state)
+}
+
+// Sets the state of the entry and updates its timestamps. The queue's mutex should be locked.
+func (q *DownloadQueue) updateEntryState(qEntry *DownloadQueueEntry, state EntryState) {
+	qEntry.State = state
+	switch {
+	case state == EntryStateStarting:
+		qEntry.StartedAt = time.Now()
+	case state.IsFinal():
+		qEntry.FinishedAt = time.Now()
+	}
+	if state == EntryStateDone {
+		d := qEntry.FinishedAt.Sub(qEntry.StartedAt)
+		if q.avgEntryDuration == 0 {
+			q.avgEntryDuration = d
+		} else {
+			q.avgEntryDuration = (q.avgEntryDuration*3 + d) / 4
+		}
+	}
+	fmt.Println("  request #", qEntry.ID, "state:", state)
+}
+
+// Returns true if the currently processed entry got canceled.
+func (q *DownloadQueue) isCurrentCanceled() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.currentCanceled
+}
+
+// Returns the current state of the entry.
+func (q *DownloadQueue) getEntryState(qEntry *DownloadQueueEntry) EntryState {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return qEntry.State
+}
+
+func formatQueueDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+func getUserName(user *models.User) string {
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// Returns the prompt and the render params of the entry, if the user is allowed to see them.
+func getQueueEntryDetails(e *DownloadQueueEntry, userID int64, admin bool) string {
+	if admin || e.Message.From.ID == userID {
+		return "\n  " + getUserName(e.Message.From) + ": " + truncateString(e.Params.OrigPrompt, 40) +
+			" (" + truncateString(e.ParamsSummary, 60) + ")"
+	}
+	return "\n  🕶 another user's request"
+}
+
+// Returns the list of the queued, processed and last finished entries. Only admins and the entry's owner can
+// see the prompt and the render params of an entry.
+func (q *DownloadQueue) GetQueueText(userID int64, admin bool) string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var res string
+	if len(q.entries) == 0 {
+		res = "👨‍👦‍👦 The queue is empty"
+	} else {
+		res = q.getActiveEntriesText(userID, admin)
+	}
+
+	if len(q.finishedEntries) > 0 {
+		res += "\n\n🏁 Finished:"
+		for i := len(q.finishedEntries) - 1; i >= 0 && i >= len(q.finishedEntries)-maxFinishedListLength; i-- {
+			e := q.finishedEntries[i]
+			res += fmt.Sprintf("\n#%d %s %s ago", e.ID, e.State, formatQueueDuration(time.Since(e.FinishedAt))) +
+				getQueueEntryDetails(e, userID, admin)
+		}
+	}
+	return res
+}
+
+// Returns the list of the queued and processed entries. The queue's mutex should be locked.
+func (q *DownloadQueue) getActiveEntriesText(userID int64, admin bool) string {
+	avgDuration := q.avgEntryDuration
+	if avgDuration == 0 {
+		avgDuration = defaultEntryDuration
+	}
+
+	entries := q.getWaitingEntries()
+	if q.currentEntry != nil {
+		entries = append([]*DownloadQueueEntry{q.currentEntry}, entries...)
+	}
+
+	res := fmt.Sprintf("👨‍👦‍👦 Queue (%d):", len(entries))
+	var startsIn time.Duration
+	var pos int
+	for i, e := range entries {
+		if i >= maxQueueListLength {
+			res += fmt.Sprintf("\n... and %d more", len(entries)-i)
+			break
+		}
+
+		var line string
+		if e == q.currentEntry {
+			elapsed := time.Since(e.StartedAt)
+			line = fmt.Sprintf("#%d ▶️ %s for %s", e.ID, e.State, formatQueueDuration(elapsed))
+			if elapsed < avgDuration {
+				startsIn = avgDuration - elapsed
+			}
+		} else {
+			pos++
+			line = fmt.Sprintf("#%d ⏳ position %d, waiting for %s, starts in ~%s", e.ID, pos,
+				formatQueueDuration(time.Since(e.CreatedAt)), formatQueueDuration(startsIn))
+			startsIn += avgDuration
+		}
+
+		res += "\n" + line + getQueueEntryDetails(e, userID, admin)
+	}
+	return res
+}
+
+// Removes the entry from the queue. The queue's mutex should be locked.
+func (q *DownloadQueue) removeEntry(qEntry *DownloadQueueEntry) {
+	for i, e := range q.entries {
+		if e == qEntry {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Sets the final state of the entry, and moves it from the queue to the finished entries. The queue's mutex
+// should be locked.
+func (q *DownloadQueue) finishEntry(qEntry *DownloadQueueEntry, state EntryState) {
+	q.updateEntryState(qEntry, state)
+	q.removeEntry(qEntry)
+	if q.currentEntry == qEntry {
+		q.currentEntry = nil
+	}
+	q.finishedEntries = append(q.finishedEntries, qEntry)
+	if len(q.finishedEntries) > maxFinishedEntries {
+		q.finishedEntries = q.finishedEntries[len(q.finishedEntries)-maxFinishedEntries:]
+	}
+}
+
+func (q *DownloadQueue) getQueuePositionString(qEntry *DownloadQueueEntry, pos int) string {
+	return fmt.Sprintf("👨‍👦‍👦 Request #%d queued at position #%d", qEntry.ID, pos)
 }
 
 func (q *DownloadQueue) queryProgress(qEntry *DownloadQueueEntry, prevProgress int) (progress int, imgs [][]byte, err error) {
 	progress = prevProgress
 
 	var newProgress int
-	newProgress, imgs, err = req.GetProgress(qEntry.TaskID)
+	newProgress, imgs, err = req.GetProgress(qEntry.StreamPath)
 	if err == nil && newProgress > prevProgress {
 		progress = newProgress
 		fmt.Print("    progress: ", progress, "%\n")
@@ -191,29 +638,281 @@ func (q *DownloadQueue) queryProgress(qEntry *DownloadQueueEntry, prevProgress i
 	return
 }
 
-func (q *DownloadQueue) processQueueEntry(renderCtx context.Context, qEntry *DownloadQueueEntry, retryAllowed bool) error {
-	fmt.Print("processing request from ", qEntry.Message.From.Username, "#", qEntry.Message.From.ID, ": ", qEntry.Params.Prompt, "\n")
+// Waits before the next retry while showing the retry count in the reply.
+func (q *DownloadQueue) waitForRetry(renderCtx context.Context, qEntry *DownloadQueueEntry, retryNr int, err error) error {
+	fmt.Println("  error:", err, "- retrying", retryNr, "/", params.RetryCount)
+	qEntry.sendReply(q.ctx, fmt.Sprintf("%s (%d/%d)...\n%s", retryingStr, retryNr, params.RetryCount,
+		qEntry.getReplyParamsText()))
 
+	select {
+	case <-renderCtx.Done():
+		return fmt.Errorf("timeout")
+	case <-time.After(getRetryDelay(retryNr)):
+	}
+	return nil
+}
+
+func (e *DownloadQueueEntry) updateRenderParamsText() {
 	var numOutputs string
-	if qEntry.Params.NumOutputs > 1 {
-		numOutputs = fmt.Sprintf("x%d", qEntry.Params.NumOutputs)
+	if e.Params.NumOutputs > 1 {
+		numOutputs = fmt.Sprintf("x%d", e.Params.NumOutputs)
+	}
+	e.RenderParamsText = fmt.Sprintf("🌱0x%X 👟%d 🕹%.1f 🖼%dx%d%s 🔭%s 🧩%s", e.Params.Seed, e.Params.NumInferenceSteps,
+		e.Params.GuidanceScale, e.Params.Width, e.Params.Height, numOutputs, e.Params.SamplerName,
+		e.Params.ModelName)
+
+	if e.Params.Variations > 0 {
+		e.RenderParamsText += fmt.Sprintf(" 🎲x%d", e.Params.Variations)
+	}
+	if len(e.Params.DynamicPrompts) > 0 {
+		e.RenderParamsText += fmt.Sprintf(" 🔀x%d", len(e.Params.DynamicPrompts))
+	}
+	if e.Params.RefinerModel != "" {
+		e.RenderParamsText += fmt.Sprintf(" 🪄%s@%.2f", e.Params.RefinerModel, e.Params.RefinerSwitch)
+	}
+	if e.Params.HiresFactor > 1 {
+		e.RenderParamsText += fmt.Sprintf(" 🔍x%g/%.2f", e.Params.HiresFactor, e.Params.HiresDenoise)
+	}
+	if e.Params.Anim != nil {
+		switch {
+		case e.Params.Anim.ToSeedSet:
+			e.RenderParamsText += fmt.Sprintf(" 🎞→🌱0x%X", e.Params.Anim.ToSeed)
+		case e.Params.Anim.ToPrompt != "":
+			e.RenderParamsText += " 🎞→" + truncateString(e.Params.Anim.ToPrompt, 30)
+		default:
+			e.RenderParamsText += fmt.Sprintf(" 🎞%s:%g..%g", e.Params.Anim.Attr, e.Params.Anim.From, e.Params.Anim.To)
+		}
+		e.RenderParamsText += fmt.Sprintf(" x%d@%dfps", e.Params.Anim.Frames, e.Params.Anim.FPS)
+	}
+	if e.Params.Extend != nil {
+		e.RenderParamsText += fmt.Sprintf(" 🧱%s+%dpx", e.Params.Extend.Dir, e.Params.Extend.Px)
+	}
+	if len(e.Params.SweepAxes) > 0 {
+		var axes []string
+		for _, axis := range e.Params.SweepAxes {
+			axes = append(axes, axis.Attr+":"+strings.Join(axis.Values, ","))
+		}
+		e.RenderParamsText += " 📊" + strings.Join(axes, " ")
+	}
+	if len(e.Params.RawOverrides) > 0 {
+		var overrides []string
+		for field, value := range e.Params.RawOverrides {
+			valueJSON, _ := json.Marshal(value)
+			overrides = append(overrides, field+"="+string(valueJSON))
+		}
+		sort.Strings(overrides)
+		e.RenderParamsText += " 🛠" + strings.Join(overrides, ",")
+	}
+	if e.Params.ClipSkip {
+		e.RenderParamsText += " ✂️clipskip"
+	}
+	if e.FallbackFrom != "" {
+		e.RenderParamsText += " ⚠️fallback from " + e.FallbackFrom
+	}
+	if len(e.OOMChanges) > 0 {
+		e.RenderParamsText += " ⚠️" + strings.Join(e.OOMChanges, ", ")
+	}
+}
+
+// Returns the render params text with the beginning of the negative prompt for progress replies.
+func (e *DownloadQueueEntry) getReplyParamsText() string {
+	if e.Params.NegativePrompt == "" {
+		return e.RenderParamsText
+	}
+	return "📍" + truncateString(e.Params.NegativePrompt, 13) + " " + e.RenderParamsText
+}
+
+// Returns the render calls needed for the entry.
+func (e *DownloadQueueEntry) getRenderSteps() (steps []RenderStep) {
+	if e.Params.Anim != nil {
+		return e.getAnimRenderSteps()
+	}
+	steps = e.getBaseRenderSteps()
+
+	// Img2img passes which are run on each output image.
+	var passes []func(p *RenderParams)
+	if e.Params.RefinerModel != "" {
+		// Easy Diffusion can't hand over the latents to the refiner, so the switch is approximated with an
+		// img2img pass on the decoded image, denoising the last (1 - switch) fraction of the steps.
+		passes = append(passes, func(p *RenderParams) {
+			p.ModelName = p.RefinerModel
+			p.RefinerModel = ""
+			p.RefinerSet = true
+			p.applyModelOverrides()
+			p.PromptStrength = 1 - p.RefinerSwitch
+		})
+	}
+	if e.Params.HiresFactor > 1 {
+		passes = append(passes, func(p *RenderParams) {
+			p.Width, p.Height = getHiresSize(p.Width, p.Height, p.HiresFactor)
+			p.PromptStrength = p.HiresDenoise
+		})
+	}
+	if len(passes) == 0 {
+		return
+	}
+
+	var passSteps []RenderStep
+	for _, step := range steps {
+		// Each output image is rendered separately, so the passes can use it as the init image.
+		for i := 0; i < step.Params.NumOutputs; i++ {
+			p := step.Params
+			p.Seed = (step.Params.Seed + uint64(i)) % (maxSeed + 1)
+			p.NumOutputs = 1
+			passSteps = append(passSteps, RenderStep{
+				Params:       p,
+				Caption:      step.Caption,
+				Intermediate: true,
+			})
+			for j, pass := range passes {
+				passParams := p
+				pass(&passParams)
+				passSteps = append(passSteps, RenderStep{
+					Params:       passParams,
+					Caption:      step.Caption,
+					UsePrevImage: true,
+					Intermediate: j < len(passes)-1,
+					Deliver:      step.Deliver && i == step.Params.NumOutputs-1 && j == len(passes)-1,
+				})
+			}
+		}
+	}
+	return passSteps
+}
+
+func (e *DownloadQueueEntry) getBaseRenderSteps() (steps []RenderStep) {
+	if e.Params.Variations > 0 {
+		for i := 0; i < e.Params.Variations; i++ {
+			p := e.Params
+			p.Seed = (e.Params.Seed + uint64(i)) % (maxSeed + 1)
+			p.NumOutputs = 1
+			steps = append(steps, RenderStep{
+				Params:  p,
+				Caption: fmt.Sprintf("🌱0x%X", p.Seed),
+			})
+		}
+		return
+	}
+	if len(e.Params.DynamicPrompts) > 0 {
+		for i, prompt := range e.Params.DynamicPrompts {
+			p := e.Params
+			p.Prompt = prompt
+			if !p.Combinatorial { // Combinations are rendered with the same seed to be comparable.
+				p.Seed = (e.Params.Seed + uint64(i)) % (maxSeed + 1)
+			}
+			steps = append(steps, RenderStep{
+				Params:  p,
+				Caption: prompt,
+			})
+		}
+		return
+	}
+	if len(e.Params.SweepAxes) > 0 {
+		xAxis := e.Params.SweepAxes[0]
+		yAxis := SweepAxis{Values: []string{""}}
+		if len(e.Params.SweepAxes) > 1 {
+			yAxis = e.Params.SweepAxes[1]
+		}
+		// Values are already validated, so errors can be ignored here.
+		for _, yVal := range yAxis.Values {
+			for _, xVal := range xAxis.Values {
+				p := e.Params
+				_ = setRenderParamAttr(&p, xAxis.Attr, xVal, true)
+				caption := xAxis.Attr + ": " + xVal
+				if yAxis.Attr != "" {
+					_ = setRenderParamAttr(&p, yAxis.Attr, yVal, true)
+					caption += ", " + yAxis.Attr + ": " + yVal
+				}
+				if xAxis.Attr == "model" || yAxis.Attr == "model" {
+					p.applyModelOverrides()
+				}
+				steps = append(steps, RenderStep{
+					Params:  p,
+					Caption: caption,
+				})
+			}
+		}
+		return
+	}
+
+	// Outputs are rendered in batches, and each batch is sent when it's ready.
+	for offset := e.DeliveredOutputs; offset < e.Params.NumOutputs; offset += e.Params.BatchSize {
+		p := e.Params
+		p.Seed = (e.Params.Seed + uint64(offset)) % (maxSeed + 1)
+		p.NumOutputs = e.Params.BatchSize
+		if offset+p.NumOutputs > e.Params.NumOutputs {
+			p.NumOutputs = e.Params.NumOutputs - offset
+		}
+		steps = append(steps, RenderStep{
+			Params:  p,
+			Deliver: true,
+		})
+	}
+	return
+}
+
+// Returns the frames of the animation. When animating to another seed or prompt, the frames between the first
+// and the last one are rendered with img2img from the first frame, with increasing prompt strength.
+func (e *DownloadQueueEntry) getAnimRenderSteps() (steps []RenderStep) {
+	a := e.Params.Anim
+	for i := 0; i < a.Frames; i++ {
+		t := float64(i) / float64(a.Frames-1)
+		step := RenderStep{Params: e.Params}
+		if a.Attr != "" {
+			v := a.From + (a.To-a.From)*t
+			switch a.Attr {
+			case "gscale":
+				step.Params.GuidanceScale = float32(v)
+			case "infsteps":
+				step.Params.NumInferenceSteps = int(math.Round(v))
+			}
+			steps = append(steps, step)
+			continue
+		}
+
+		if i > 0 {
+			if a.ToSeedSet {
+				step.Params.Seed = a.ToSeed
+			} else {
+				step.Params.Prompt = a.ToPrompt
+			}
+			if i < a.Frames-1 { // The last frame is rendered without the init image.
+				step.UseFirstImage = true
+				step.Params.PromptStrength = float32(t)
+			}
+		}
+		steps = append(steps, step)
 	}
-	qEntry.RenderParamsText = fmt.Sprintf("🌱0x%X 👟%d 🕹%.1f 🖼%dx%d%s 🔭%s 🧩%s", qEntry.Params.Seed, qEntry.Params.NumInferenceSteps,
-		qEntry.Params.GuidanceScale, qEntry.Params.Width, qEntry.Params.Height, numOutputs, qEntry.Params.SamplerName,
-		qEntry.Params.ModelName)
+	return
+}
+
+// Renders the given step of the entry and returns the result images.
+func (q *DownloadQueue) render(renderCtx context.Context, qEntry *DownloadQueueEntry, step RenderStep, stepNr, stepCount int,
+	retryAllowed bool) (imgs [][]byte, err error) {
 
-	if qEntry.Params.NegativePrompt != "" {
-		negText := qEntry.Params.NegativePrompt
-		if len(negText) > 10 {
-			negText = negText[:10] + "..."
+	defer func() {
+		if errors.Is(err, ErrModelLoad) {
+			err = &ModelLoadError{Model: step.Params.ModelName, Err: err}
 		}
-		qEntry.RenderParamsText = "📍" + negText + " " + qEntry.RenderParamsText
+	}()
+
+	// Not sending a new task to the backend if the entry got canceled since the previous step.
+	if err := renderCtx.Err(); err != nil {
+		return nil, err
 	}
 
-	qEntry.sendReply(q.ctx, processStartStr+"\n"+qEntry.RenderParamsText)
+	renderCtx, renderCtxCancel := context.WithTimeout(renderCtx, processTimeout)
+	defer renderCtxCancel()
 
-	var err error
-	qEntry.TaskID, err = req.Render(qEntry.Params)
+	for retryNr := 1; ; retryNr++ {
+		qEntry.TaskID, qEntry.StreamPath, err = req.Render(step.Params)
+		if err == nil || !isRetryableError(err) || retryNr > params.RetryCount {
+			break
+		}
+		if err := q.waitForRetry(renderCtx, qEntry, retryNr, err); err != nil {
+			return nil, err
+		}
+	}
 	if err != nil {
 		if errors.Is(err, syscall.ECONNREFUSED) { // Can't connect to Easy Diffusion?
 			qEntry.sendReply(q.ctx, restartStr)
@@ -224,14 +923,24 @@ func (q *DownloadQueue) processQueueEntry(renderCtx context.Context, qEntry *Dow
 				panic(err.Error())
 			}
 			if retryAllowed {
-				return q.processQueueEntry(renderCtx, qEntry, false)
+				return q.render(renderCtx, qEntry, step, stepNr, stepCount, false)
 			} else {
-				return nil
+				return nil, nil
 			}
 		}
-		return err
+		return nil, err
+	}
+	fmt.Println("  render started with task id", qEntry.TaskID, "session id", step.Params.SessionID)
+	if q.getEntryState(qEntry) != EntryStateRendering {
+		q.setEntryState(qEntry, EntryStateRendering)
+	}
+
+	var stepStr string
+	if qEntry.Params.Anim != nil {
+		stepStr = fmt.Sprintf(" 🎞 %d/%d frames", stepNr, stepCount)
+	} else if stepCount > 1 {
+		stepStr = fmt.Sprintf(" (%d/%d)", stepNr+1, stepCount)
 	}
-	fmt.Println("  render started with task id", qEntry.TaskID)
 
 	progressUpdateInterval := groupChatProgressUpdateInterval
 	if qEntry.Message.Chat.ID >= 0 {
@@ -255,28 +964,112 @@ func (q *DownloadQueue) processQueueEntry(renderCtx context.Context, qEntry *Dow
 	}()
 
 	var progress int
-	var imgs [][]byte
-checkLoop:
+	var progressRetryNr int
 	for {
 		select {
 		case <-renderCtx.Done():
-			return fmt.Errorf("timeout")
+			return nil, fmt.Errorf("timeout")
 		case <-progressPercentUpdateTicker.C:
-			qEntry.sendReply(q.ctx, processStr+" "+getProgressbar(progress, progressBarLength)+"\n"+qEntry.RenderParamsText)
+			totalProgress := (stepNr*100 + progress) / stepCount
+			qEntry.sendReply(q.ctx, processStr+stepStr+" "+getProgressbar(totalProgress, progressBarLength)+"\n"+
+				qEntry.getReplyParamsText())
 		case <-progressCheckTicker.C:
 			progress, imgs, err = q.queryProgress(qEntry, progress)
 			if err != nil {
-				return err
+				progressRetryNr++
+				if !isRetryableError(err) || progressRetryNr > params.RetryCount {
+					return nil, err
+				}
+				if err := q.waitForRetry(renderCtx, qEntry, progressRetryNr, err); err != nil {
+					return nil, err
+				}
+				continue
 			}
+			progressRetryNr = 0
 			if imgs != nil {
-				break checkLoop
+				return imgs, nil
 			}
 		}
 	}
+}
+
+func (q *DownloadQueue) processQueueEntry(renderCtx context.Context, qEntry *DownloadQueueEntry) error {
+	fmt.Print("processing request from ", qEntry.Message.From.Username, "#", qEntry.Message.From.ID, ": ", qEntry.Params.Prompt, "\n")
+
+	qEntry.updateRenderParamsText()
+	qEntry.sendReply(q.ctx, processStartStr+"\n"+qEntry.getReplyParamsText())
+
+	var imgs, prevImgs, firstImgs [][]byte
+	var captions []string
+	steps := qEntry.getRenderSteps()
+	for i, step := range steps {
+		if step.UsePrevImage {
+			if len(prevImgs) != 1 {
+				return fmt.Errorf("missing init image")
+			}
+			step.Params.InitImage = prevImgs[0]
+		}
+		if step.UseFirstImage {
+			if len(firstImgs) != 1 {
+				return fmt.Errorf("missing init image")
+			}
+			step.Params.InitImage = firstImgs[0]
+		}
+
+		stepImgs, err := q.render(renderCtx, qEntry, step, i, len(steps), true)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			firstImgs = stepImgs
+		}
+		prevImgs = stepImgs
+		if step.Intermediate {
+			continue
+		}
+		for _, img := range stepImgs {
+			imgs = append(imgs, img)
+			captions = append(captions, step.Caption)
+		}
+
+		if step.Deliver && i < len(steps)-1 {
+			fmt.Println("  uploading batch...")
+			qEntry.sendImages(q.ctx, imgs, captions, true)
+			qEntry.DeliveredOutputs += len(imgs)
+			imgs = nil
+			captions = nil
+		}
+	}
+
+	if len(qEntry.Params.SweepAxes) > 0 {
+		colLabels, rowLabels := qEntry.Params.getSweepGridLabels()
+		grid, err := composeGrid(imgs, colLabels, rowLabels)
+		if err != nil {
+			fmt.Println("  grid compose error:", err)
+		} else {
+			imgs = append([][]byte{grid}, imgs...)
+			captions = append([]string{""}, captions...)
+		}
+	}
+
+	if qEntry.Params.Anim != nil {
+		anim, err := composeGIF(imgs, qEntry.Params.Anim.FPS)
+		if err != nil {
+			return fmt.Errorf("can't compose animation: %w", err)
+		}
+		fmt.Println("  uploading...")
+		q.setEntryState(qEntry, EntryStateUploading)
+		qEntry.sendReply(q.ctx, uploadingStr+"\n"+qEntry.getReplyParamsText())
+		qEntry.sendAnimation(q.ctx, anim, true)
+		qEntry.deleteReply(q.ctx)
+		return nil
+	}
 
 	fmt.Println("  uploading...")
-	qEntry.sendReply(q.ctx, uploadingStr+"\n"+qEntry.RenderParamsText)
-	qEntry.sendImages(q.ctx, imgs, true)
+	q.setEntryState(qEntry, EntryStateUploading)
+	qEntry.sendReply(q.ctx, uploadingStr+"\n"+qEntry.getReplyParamsText())
+	qEntry.sendImages(q.ctx, imgs, captions, true)
+	qEntry.DeliveredOutputs += len(imgs)
 	qEntry.deleteReply(q.ctx)
 
 	return nil
@@ -291,42 +1084,87 @@ func (q *DownloadQueue) processor() {
 			continue
 		}
 
-		// Updating queue positions for all waiting entries.
-		for i := 1; i < len(q.entries); i++ {
-			sendReplyToMessage(q.ctx, q.entries[i].Message, q.getQueuePositionString(i))
-		}
+		qEntry := q.getNextEntry()
 
-		qEntry := &q.entries[0]
+		if time.Since(qEntry.CreatedAt) > params.QueuedEntryExpiry {
+			fmt.Println("  request #", qEntry.ID, "expired")
+			q.finishEntry(qEntry, EntryStateExpired)
+			q.mutex.Unlock()
+			qEntry.sendReply(q.ctx, expiredStr)
+			continue
+		}
 
-		q.currentEntry = DownloadQueueCurrentEntry{}
+		q.currentEntry = qEntry
+		q.updateEntryState(qEntry, EntryStateStarting)
+		q.currentCanceled = false
 		var renderCtx context.Context
-		renderCtx, q.currentEntry.ctxCancel = context.WithTimeout(q.ctx, processTimeout)
+		renderCtx, q.currentCtxCancel = context.WithCancel(q.ctx)
+		updates := q.updateQueuePositions()
 		q.mutex.Unlock()
 
-		err := q.processQueueEntry(renderCtx, qEntry, true)
+		q.sendQueuePositionUpdates(updates)
+		err := q.processQueueEntry(renderCtx, qEntry)
+		var modelLoadErr *ModelLoadError
+		if errors.As(err, &modelLoadErr) {
+			fmt.Println("  model", modelLoadErr.Model, "failed to load:", err)
+			sendMessageToAdmins(q.ctx, "🧩 Model "+modelLoadErr.Model+" failed to load: "+err.Error())
+
+			// Falling back only helps if the base model failed, and makes no sense when comparing models.
+			if params.ModelFallback && params.DefaultModel != "" && modelLoadErr.Model == qEntry.Params.ModelName &&
+				qEntry.Params.ModelName != params.DefaultModel && qEntry.Params.getSweepAxis("model") == nil &&
+				!q.isCurrentCanceled() {
+
+				fmt.Println("  falling back to model", params.DefaultModel)
+				qEntry.FallbackFrom = qEntry.Params.ModelName
+				qEntry.Params.ModelName = params.DefaultModel
+				qEntry.Params.applyModelOverrides()
+				qEntry.sendReply(q.ctx, modelFallbackStr+" "+params.DefaultModel+"...")
+				err = q.processQueueEntry(renderCtx, qEntry)
+			}
+		}
+		for errors.Is(err, ErrOutOfMemory) && !q.isCurrentCanceled() {
+			change := qEntry.reduceMemoryUsage()
+			if change == "" {
+				break
+			}
+			fmt.Println("  out of memory, retrying with", change)
+			qEntry.OOMChanges = append(qEntry.OOMChanges, change)
+			qEntry.sendReply(q.ctx, outOfMemoryStr+" "+change+"...")
+			err = q.processQueueEntry(renderCtx, qEntry)
+		}
 
 		q.mutex.Lock()
-		if q.currentEntry.canceled {
+		canceled := q.currentCanceled
+		q.currentCtxCancel()
+		state := EntryStateDone
+		if canceled {
+			state = EntryStateCanceled
+		} else if err != nil {
+			state = EntryStateFailed
+		}
+		// Finishing in the same critical section, so a cancel can't slip in after the state is decided.
+		q.finishEntry(qEntry, state)
+		queueEmpty := len(q.entries) == 0
+		q.mutex.Unlock()
+
+		switch state {
+		case EntryStateCanceled:
 			fmt.Print("  canceled\n")
 			req.Stop(qEntry.TaskID)
 			qEntry.sendReply(q.ctx, canceledStr)
-		} else if err != nil {
+		case EntryStateFailed:
 			fmt.Println("  error:", err)
 			qEntry.sendReply(q.ctx, errorStr+": "+err.Error())
 		}
-
-		q.currentEntry.ctxCancel()
-
-		q.entries = q.entries[1:]
-		if len(q.entries) == 0 {
+		if queueEmpty {
 			fmt.Print("finished queue processing\n")
 		}
-		q.mutex.Unlock()
 	}
 }
 
 func (q *DownloadQueue) Init(ctx context.Context) {
 	q.ctx = ctx
 	q.processReqChan = make(chan bool)
+	q.lastVirtualTimes = make(map[int64]float64)
 	go q.processor()
 }
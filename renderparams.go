@@ -0,0 +1,560 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Telegram albums can contain max. 10 images.
+const maxVariations = 10
+const maxSweepCells = 25
+
+// Attributes which can have comma separated values for parameter sweeps, and their canonical names.
+var sweepableAttrs = map[string]string{
+	"seed":     "seed",
+	"s":        "seed",
+	"infsteps": "infsteps",
+	"i":        "infsteps",
+	"gscale":   "gscale",
+	"g":        "gscale",
+	"sampler":  "sampler",
+	"r":        "sampler",
+	"model":    "model",
+	"m":        "model",
+}
+
+const minImageSize = 128
+const maxImageSize = 2048
+const imageSizeStep = 8 // The backend needs sizes which are multiples of this.
+const calculatedImageSizeStep = 64
+const maxHiresFactor = 4
+
+// Width/height ratios of named sizes.
+var sizePresets = map[string]float64{
+	"square":    1,
+	"portrait":  2.0 / 3.0,
+	"landscape": 3.0 / 2.0,
+	"phone":     9.0 / 19.5,
+}
+
+type RenderMode int
+
+const (
+	RenderModeImages RenderMode = iota
+	RenderModeAnim
+	RenderModeExtend
+)
+
+var promptParser = PromptParser{
+	FlagAttrs:          []string{"clipskip", "combinatorial"},
+	NegativePromptAttr: "neg",
+}
+
+func isValidSampler(sampler string) bool {
+	switch sampler {
+	case "plms", "ddim", "heun", "euler", "euler_a", "dpm2", "dpm2_a", "lms",
+		"dpm_solver_stability", "dpmpp_2s_a", "dpmpp_2m", "dpmpp_2m_sde",
+		"dpmpp_sde", "dpm_adaptive", "ddpm", "deis", "unipc_snr", "unipc_tu",
+		"unipc_snr_2", "unipc_tu_2", "unipc_tq":
+		return true
+	}
+	return false
+}
+
+// Sets the render param attribute to the given value. The returned error can be shown to the user.
+func setRenderParamAttr(p *RenderParams, attr, val string, admin bool) error {
+	switch attr {
+	case "seed", "s":
+		seed, err := parseSeed(val)
+		if err != nil {
+			return err
+		}
+		p.Seed = seed
+		p.UsedRandomSeed = false
+	case "width", "w":
+		valInt, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid width")
+		}
+		p.Width = valInt
+		p.WidthSet = true
+	case "height", "h":
+		valInt, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid height")
+		}
+		p.Height = valInt
+		p.HeightSet = true
+	case "ar":
+		ratio, err := parseAspectRatio(val)
+		if err != nil {
+			return err
+		}
+		p.AspectRatio = ratio
+	case "size":
+		ratio, ok := sizePresets[strings.ToLower(val)]
+		if !ok {
+			return fmt.Errorf("invalid size, valid sizes are square, portrait, landscape and phone")
+		}
+		p.AspectRatio = ratio
+	case "hires":
+		valFloat, err := strconv.ParseFloat(val, 64)
+		if err != nil || valFloat < 1 || valFloat > maxHiresFactor {
+			return fmt.Errorf("invalid hires factor, should be between 1 and %d", maxHiresFactor)
+		}
+		p.HiresFactor = valFloat
+	case "hiresdenoise":
+		valFloat, err := strconv.ParseFloat(val, 32)
+		if err != nil || valFloat <= 0 || valFloat > 1 {
+			return fmt.Errorf("invalid hires denoise, should be between 0 and 1")
+		}
+		p.HiresDenoise = float32(valFloat)
+	case "refiner":
+		if strings.ToLower(val) == "none" {
+			val = ""
+		}
+		p.RefinerModel = resolveModelAlias(val)
+		p.RefinerSet = true
+	case "refinerswitch":
+		valFloat, err := strconv.ParseFloat(val, 32)
+		if err != nil || valFloat <= 0 || valFloat >= 1 {
+			return fmt.Errorf("invalid refiner switch, should be between 0 and 1")
+		}
+		p.RefinerSwitch = float32(valFloat)
+	case "infsteps", "i":
+		valInt, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid inference steps")
+		}
+		p.NumInferenceSteps = valInt
+	case "outcnt", "o":
+		valInt, err := strconv.Atoi(val)
+		if err != nil || valInt < 1 || valInt > params.MaxOutputs {
+			return fmt.Errorf("invalid output count, should be between 1 and %d", params.MaxOutputs)
+		}
+		p.NumOutputs = valInt
+	case "gscale", "g":
+		valFloat, err := strconv.ParseFloat(val, 32)
+		if err != nil {
+			return fmt.Errorf("invalid guidance scale")
+		}
+		p.GuidanceScale = float32(valFloat)
+	case "sampler", "r":
+		val = strings.ToLower(val)
+		if !isValidSampler(val) {
+			return fmt.Errorf("invalid sampler")
+		}
+		p.SamplerName = val
+	case "vary":
+		valInt, err := strconv.Atoi(val)
+		if err != nil || valInt < 1 || valInt > maxVariations {
+			return fmt.Errorf("invalid variation count, should be between 1 and %d", maxVariations)
+		}
+		p.Variations = valInt
+	case "model", "m":
+		p.ModelName = resolveModelAlias(val)
+	case "combinatorial":
+		switch val {
+		case "", "1":
+			p.Combinatorial = true
+		case "0":
+			p.Combinatorial = false
+		default:
+			return fmt.Errorf("invalid combinatorial value")
+		}
+	case "frames", "fps", "toseed", "toprompt", "anim":
+		if p.Anim == nil {
+			return fmt.Errorf("attribute %s can only be used with /edanim", attr)
+		}
+		return setAnimParamAttr(p.Anim, attr, val)
+	case "dir":
+		if p.Extend == nil {
+			return fmt.Errorf("attribute %s can only be used with /edextend", attr)
+		}
+		val = strings.ToLower(val)
+		switch val {
+		case "left", "right", "up", "down":
+			p.Extend.Dir = val
+		default:
+			return fmt.Errorf("invalid direction, valid directions are left, right, up and down")
+		}
+	case "px":
+		if p.Extend == nil {
+			return fmt.Errorf("attribute %s can only be used with /edextend", attr)
+		}
+		valInt, err := strconv.Atoi(val)
+		if err != nil || valInt < minExtendPx || valInt > maxExtendPx {
+			return fmt.Errorf("invalid extension size, should be between %d and %d", minExtendPx, maxExtendPx)
+		}
+		p.Extend.Px = valInt / imageSizeStep * imageSizeStep
+	case "vram":
+		if !admin {
+			return fmt.Errorf("attribute %s is admin only", attr)
+		}
+		val = strings.ToLower(val)
+		if !isValidVRAMUsageLevel(val) {
+			return fmt.Errorf("invalid vram usage level")
+		}
+		p.VRAMUsageLevel = val
+		p.VRAMUsageLevelSet = true
+	case "clipskip":
+		if !admin {
+			return fmt.Errorf("attribute %s is admin only", attr)
+		}
+		switch val {
+		case "", "1":
+			p.ClipSkip = true
+		case "0":
+			p.ClipSkip = false
+		default:
+			return fmt.Errorf("invalid clip skip")
+		}
+		p.ClipSkipSet = true
+	case "x":
+		if !admin {
+			return fmt.Errorf("attribute %s is admin only", attr)
+		}
+		field, fieldVal, ok := strings.Cut(val, "=")
+		if !ok {
+			return fmt.Errorf("invalid raw field override, use -x:field=value")
+		}
+		value := parseRawOverrideValue(fieldVal)
+		if err := validateRawOverride(field, value); err != nil {
+			return err
+		}
+		if p.RawOverrides == nil {
+			p.RawOverrides = make(map[string]any)
+		}
+		p.RawOverrides[field] = value
+	default:
+		return fmt.Errorf("invalid attribute %s", attr)
+	}
+	return nil
+}
+
+// Parses hex seeds with an optional 🌱 and 0x prefix.
+func parseSeed(val string) (uint64, error) {
+	val = strings.TrimPrefix(val, "🌱")
+	val = strings.TrimPrefix(val, "0x")
+	valInt := new(big.Int)
+	if _, ok := valInt.SetString(val, 16); !ok || valInt.Sign() < 0 {
+		return 0, fmt.Errorf("invalid seed")
+	}
+	if !valInt.IsUint64() || valInt.Uint64() > maxSeed {
+		return 0, fmt.Errorf("seed out of range, max. is 0x%X", uint64(maxSeed))
+	}
+	return valInt.Uint64(), nil
+}
+
+func setAnimParamAttr(a *AnimParams, attr, val string) error {
+	switch attr {
+	case "frames":
+		valInt, err := strconv.Atoi(val)
+		if err != nil || valInt < 2 || valInt > maxAnimFrames {
+			return fmt.Errorf("invalid frame count, should be between 2 and %d", maxAnimFrames)
+		}
+		a.Frames = valInt
+	case "fps":
+		valInt, err := strconv.Atoi(val)
+		if err != nil || valInt < 1 || valInt > maxAnimFPS {
+			return fmt.Errorf("invalid fps, should be between 1 and %d", maxAnimFPS)
+		}
+		a.FPS = valInt
+	case "toseed":
+		seed, err := parseSeed(val)
+		if err != nil {
+			return err
+		}
+		a.ToSeed = seed
+		a.ToSeedSet = true
+	case "toprompt":
+		if strings.TrimSpace(val) == "" {
+			return fmt.Errorf("invalid target prompt")
+		}
+		a.ToPrompt = strings.TrimSpace(val)
+	case "anim": // In attr:from..to format.
+		animAttr, valRange, ok := strings.Cut(val, ":")
+		fromStr, toStr, ok2 := strings.Cut(valRange, "..")
+		if !ok || !ok2 {
+			return fmt.Errorf("invalid animated attribute, use -anim:attr:from..to")
+		}
+		a.Attr, ok = animatableAttrs[strings.ToLower(animAttr)]
+		if !ok {
+			return fmt.Errorf("attribute %s can't be animated", animAttr)
+		}
+		var err error
+		if a.From, err = strconv.ParseFloat(fromStr, 64); err != nil || a.From <= 0 {
+			return fmt.Errorf("invalid animation start value")
+		}
+		if a.To, err = strconv.ParseFloat(toStr, 64); err != nil || a.To <= 0 {
+			return fmt.Errorf("invalid animation end value")
+		}
+	}
+	return nil
+}
+
+// Parses aspect ratios in W:H format.
+func parseAspectRatio(val string) (float64, error) {
+	wStr, hStr, ok := strings.Cut(val, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid aspect ratio, use W:H format")
+	}
+	w, err := strconv.ParseFloat(wStr, 64)
+	if err != nil || w <= 0 {
+		return 0, fmt.Errorf("invalid aspect ratio")
+	}
+	h, err := strconv.ParseFloat(hStr, 64)
+	if err != nil || h <= 0 {
+		return 0, fmt.Errorf("invalid aspect ratio")
+	}
+	return w / h, nil
+}
+
+func roundImageSize(size float64) int {
+	res := int(math.Round(size/calculatedImageSizeStep)) * calculatedImageSizeStep
+	if res < calculatedImageSizeStep {
+		res = calculatedImageSizeStep
+	}
+	return res
+}
+
+// Returns the resolution the model was trained on.
+func getModelNativeResolution(model string) int {
+	if cfg, ok := params.ModelConfigs[model]; ok && cfg.Width > 0 {
+		return int(math.Sqrt(float64(cfg.Width * cfg.Height)))
+	}
+	if strings.Contains(strings.ToLower(model), "xl") {
+		return 1024
+	}
+	return 512
+}
+
+// Calculates the width and height from the aspect ratio. If one of them is set by the user, only the other one
+// is calculated, otherwise the size is calculated from the model's native resolution.
+func (p *RenderParams) applyAspectRatio() error {
+	if p.AspectRatio == 0 {
+		return nil
+	}
+	switch {
+	case p.WidthSet && p.HeightSet:
+		return fmt.Errorf("aspect ratio can't be used when both width and height are set")
+	case p.WidthSet:
+		p.Height = roundImageSize(float64(p.Width) / p.AspectRatio)
+	case p.HeightSet:
+		p.Width = roundImageSize(float64(p.Height) * p.AspectRatio)
+	default:
+		nativeRes := float64(getModelNativeResolution(p.ModelName))
+		p.Width = roundImageSize(nativeRes * math.Sqrt(p.AspectRatio))
+		p.Height = roundImageSize(nativeRes / math.Sqrt(p.AspectRatio))
+	}
+	return nil
+}
+
+// Returns the size of the hires fix second pass.
+func getHiresSize(width, height int, factor float64) (int, int) {
+	return roundImageSize(float64(width) * factor), roundImageSize(float64(height) * factor)
+}
+
+func validateImageSize(width, height int) error {
+	if width < minImageSize || height < minImageSize || width > maxImageSize || height > maxImageSize {
+		return fmt.Errorf("image size should be between %d and %d", minImageSize, maxImageSize)
+	}
+	if width%imageSizeStep != 0 || height%imageSizeStep != 0 {
+		return fmt.Errorf("image width and height should be multiples of %d", imageSizeStep)
+	}
+	return nil
+}
+
+// Adds a sweep axis with the comma separated values of the attribute.
+func (p *RenderParams) addSweepAxis(attr, val string, admin bool) error {
+	if p.getSweepAxis(attr) != nil {
+		return fmt.Errorf("duplicate sweep attribute %s", attr)
+	}
+	axis := SweepAxis{Attr: attr}
+	for _, v := range strings.Split(val, ",") {
+		pCopy := *p // Only validating the value here, it gets applied when rendering.
+		if err := setRenderParamAttr(&pCopy, attr, v, admin); err != nil {
+			return err
+		}
+		axis.Values = append(axis.Values, v)
+	}
+	p.SweepAxes = append(p.SweepAxes, axis)
+	return nil
+}
+
+func (p *RenderParams) validateAnim() error {
+	modes := 0
+	for _, set := range []bool{p.Anim.ToSeedSet, p.Anim.ToPrompt != "", p.Anim.Attr != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return fmt.Errorf("set exactly one of the toseed, toprompt or anim attributes")
+	}
+	if p.Variations > 0 || len(p.SweepAxes) > 0 || p.HiresFactor > 1 {
+		return fmt.Errorf("animations can't be used with variations, multiple attribute values or hires fix")
+	}
+	// Frames are interpolated from the first frame, refining them separately would cause flicker.
+	if p.RefinerSet && p.RefinerModel != "" {
+		return fmt.Errorf("the refiner can't be used with animations")
+	}
+	// The model's default refiner is cleared, and marked as set, so per-model overrides don't enable it again.
+	p.RefinerModel = ""
+	p.RefinerSet = true
+	p.NumOutputs = 1
+	return nil
+}
+
+func (p *RenderParams) validateExtend() error {
+	if p.WidthSet || p.HeightSet || p.AspectRatio != 0 {
+		return fmt.Errorf("the size can't be set when extending, it's calculated from the photo")
+	}
+	if p.HiresFactor > 1 {
+		return fmt.Errorf("hires fix can't be used when extending")
+	}
+	// The refiner would change the original part of the image too.
+	if p.RefinerSet && p.RefinerModel != "" {
+		return fmt.Errorf("the refiner can't be used when extending")
+	}
+	// The model's default refiner is cleared, and marked as set, so per-model overrides don't enable it again.
+	p.RefinerModel = ""
+	p.RefinerSet = true
+	return nil
+}
+
+// Returns the render params parsed from the given text. The returned error can be shown to the user.
+// The mode sets which command specific attributes can be used.
+func getRenderParams(text string, userID int64, mode RenderMode) (renderParams RenderParams, err error) {
+	renderParams = RenderParams{
+		OrigPrompt:        text,
+		Seed:              uint64(rand.Int63n(maxSeed + 1)),
+		UsedRandomSeed:    true,
+		Width:             512,
+		Height:            512,
+		NumInferenceSteps: 20,
+		NumOutputs:        4,
+		BatchSize:         params.BatchSize,
+		GuidanceScale:     7,
+		SamplerName:       params.DefaultSampler,
+		ModelName:         params.DefaultModel,
+		VRAMUsageLevel:    params.DefaultVRAMUsageLevel,
+		ClipSkip:          params.DefaultClipSkip,
+		RenderDevice:      params.RenderDevice,
+		SessionID:         getSessionID(userID),
+		HiresDenoise:      params.DefaultHiresDenoise,
+		RefinerSwitch:     params.DefaultRefinerSwitch,
+	}
+	switch mode {
+	case RenderModeAnim:
+		renderParams.Anim = &AnimParams{Frames: defaultAnimFrames, FPS: defaultAnimFPS}
+	case RenderModeExtend:
+		renderParams.Extend = &ExtendParams{Dir: "right", Px: defaultExtendPx}
+	}
+
+	parsed, err := promptParser.Parse(text)
+	if err != nil {
+		return renderParams, err
+	}
+	renderParams.OrigPrompt = parsed.RawPrompt
+	renderParams.Prompt = parsed.Prompt
+	renderParams.NegativePrompt = parsed.NegativePrompt
+
+	// The model's defaults are applied before the user's attributes, so they can be overridden.
+	for _, attr := range parsed.Attrs {
+		if (attr.Name == "model" || attr.Name == "m") && !strings.Contains(attr.Value, ",") {
+			renderParams.ModelName = resolveModelAlias(attr.Value)
+		}
+	}
+	renderParams.applyModelDefaults()
+
+	// Collecting all attribute errors to report them at once.
+	admin := isAdmin(userID)
+	var errs []string
+	for _, attr := range parsed.Attrs {
+		var err error
+		if sweepAttr, ok := sweepableAttrs[attr.Name]; ok && strings.Contains(attr.Value, ",") {
+			err = renderParams.addSweepAxis(sweepAttr, attr.Value, admin)
+		} else {
+			err = setRenderParamAttr(&renderParams, attr.Name, attr.Value, admin)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return renderParams, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	if len(renderParams.SweepAxes) > 0 {
+		if len(renderParams.SweepAxes) > 2 {
+			return renderParams, fmt.Errorf("max. 2 attributes can have multiple values")
+		}
+		if renderParams.Variations > 0 {
+			return renderParams, fmt.Errorf("variations can't be used with multiple attribute values")
+		}
+		if renderParams.getSweepCellCount() > maxSweepCells {
+			return renderParams, fmt.Errorf("too many attribute value combinations, max. is %d", maxSweepCells)
+		}
+		renderParams.NumOutputs = 1 // Each combination is rendered once.
+	}
+
+	if renderParams.Variations > 0 { // Variations are rendered one by one.
+		renderParams.NumOutputs = 1
+	}
+
+	renderParams.applyModelOverrides()
+
+	if renderParams.Anim != nil {
+		if err := renderParams.validateAnim(); err != nil {
+			return renderParams, err
+		}
+	}
+	if renderParams.Extend != nil {
+		if err := renderParams.validateExtend(); err != nil {
+			return renderParams, err
+		}
+	}
+
+	if err := renderParams.applyAspectRatio(); err != nil {
+		return renderParams, err
+	}
+	if err := validateImageSize(renderParams.Width, renderParams.Height); err != nil {
+		return renderParams, err
+	}
+	if renderParams.HiresFactor > 1 {
+		if err := validateImageSize(getHiresSize(renderParams.Width, renderParams.Height, renderParams.HiresFactor)); err != nil {
+			return renderParams, fmt.Errorf("hires %w", err)
+		}
+	}
+
+	if renderParams.Prompt == "" {
+		return renderParams, fmt.Errorf("missing prompt")
+	}
+
+	if hasDynamicPrompt(renderParams.Prompt) {
+		if renderParams.Variations > 0 || len(renderParams.SweepAxes) > 0 || renderParams.Anim != nil {
+			return renderParams, fmt.Errorf("dynamic prompts can't be used with variations, multiple attribute values or animations")
+		}
+
+		if renderParams.Combinatorial {
+			renderParams.DynamicPrompts, err = expandPromptCombinatorial(renderParams.Prompt, 0)
+		} else {
+			for i := 0; i < renderParams.NumOutputs && i < maxDynamicPrompts && err == nil; i++ {
+				var p string
+				p, err = expandPromptRandom(renderParams.Prompt, 0)
+				renderParams.DynamicPrompts = append(renderParams.DynamicPrompts, p)
+			}
+		}
+		if err != nil {
+			return renderParams, err
+		}
+		renderParams.NumOutputs = 1 // Each expanded prompt is rendered once.
+	}
+
+	return renderParams, nil
+}
@@ -4,27 +4,114 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"golang.org/x/exp/slices"
 )
 
 const reqURL = "http://localhost:9000"
 
-type ReqType struct{}
+// Used if the render response doesn't contain the stream URL.
+const streamPathFmt = "/image/stream/%d"
+
+// The backend also seeds numpy's random generator with the seed, which only accepts 32 bit values.
+const maxSeed = math.MaxUint32
+
+var rawOverrideFieldRegex = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+var ErrOutOfMemory = errors.New("out of memory")
+var ErrModelLoad = errors.New("model load error")
+
+// Wraps model load errors with the name of the model which failed to load.
+type ModelLoadError struct {
+	Model string
+	Err   error
+}
+
+func (e *ModelLoadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ModelLoadError) Unwrap() error {
+	return e.Err
+}
+
+type ReqStatusError struct {
+	StatusCode int
+	Detail     string
+}
+
+func (e *ReqStatusError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("got http status %d: %s", e.StatusCode, e.Detail)
+	}
+	return fmt.Sprintf("got http status %d", e.StatusCode)
+}
+
+// Returns true if the error is a transient backend failure which is worth retrying.
+func isRetryableError(err error) bool {
+	var statusErr *ReqStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Ping statuses which mean that the server is up.
+var edOnlineStatuses = []string{"Online", "Rendering", "LoadingModel"}
+
+type ReqType struct {
+	Version EDVersion
+}
+
+// Detects the Easy Diffusion version and selects the matching API compatibility settings.
+func (r *ReqType) DetectVersion() error {
+	res, err := r.req("/", nil)
+	if err != nil {
+		return fmt.Errorf("can't detect easy diffusion version: %s", err.Error())
+	}
+	var ok bool
+	r.Version, ok = parseEDVersion(res)
+	if !ok {
+		return fmt.Errorf("can't detect easy diffusion version, supported versions are %s and %s",
+			edAPICompatV2.Name, edAPICompatV3.Name)
+	}
+	if _, err = getEDAPICompat(r.Version); err != nil {
+		return err
+	}
+	fmt.Println("  easy diffusion version:", r.Version)
+	return nil
+}
 
 func (r *ReqType) req(path string, postData []byte) (string, error) {
 	client := http.Client{
 		Timeout: 3 * time.Second,
 	}
-	path, err := url.JoinPath(reqURL, path)
+	// The query is set separately, as joining would escape the question mark.
+	path, query, _ := strings.Cut(path, "?")
+	u, err := url.Parse(reqURL)
 	if err != nil {
 		return "", err
 	}
+	u = u.JoinPath(path)
+	u.RawQuery = query
+	path = u.String()
 
 	var request *http.Request
 	if postData != nil {
@@ -41,7 +128,7 @@ func (r *ReqType) req(path string, postData []byte) (string, error) {
 	}
 
 	resp, err := client.Do(request)
-	if err != nil || resp.StatusCode != 200 {
+	if err != nil {
 		return "", err
 	}
 	bodyBytes, err := io.ReadAll(resp.Body)
@@ -49,6 +136,13 @@ func (r *ReqType) req(path string, postData []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if resp.StatusCode != 200 {
+		var errResp struct {
+			Detail string `json:"detail"`
+		}
+		_ = json.Unmarshal(bodyBytes, &errResp)
+		return "", &ReqStatusError{StatusCode: resp.StatusCode, Detail: errResp.Detail}
+	}
 	return string(bodyBytes), nil
 }
 
@@ -64,7 +158,7 @@ func (r *ReqType) Ping() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return pingRes.Status == "Online", nil
+	return slices.Contains(edOnlineStatuses, pingRes.Status), nil
 }
 
 type RenderReq struct {
@@ -74,6 +168,8 @@ type RenderReq struct {
 	GuidanceScale           float32  `json:"guidance_scale"`
 	Height                  uint32   `json:"height"`
 	InactiveTags            []string `json:"inactive_tags"`
+	InitImage               string   `json:"init_image,omitempty"`
+	Mask                    string   `json:"mask,omitempty"`
 	MetadataOutputFormat    string   `json:"metadata_output_format"`
 	NegativePrompt          string   `json:"negative_prompt"`
 	NumInferenceSteps       uint32   `json:"num_inference_steps"`
@@ -83,8 +179,10 @@ type RenderReq struct {
 	OutputLossless          bool     `json:"output_lossless"`
 	OutputQuality           uint32   `json:"output_quality"`
 	Prompt                  string   `json:"prompt"`
+	PromptStrength          float32  `json:"prompt_strength,omitempty"`
+	RenderDevice            string   `json:"render_device,omitempty"`
 	SamplerName             string   `json:"sampler_name"`
-	Seed                    uint32   `json:"seed"`
+	Seed                    uint64   `json:"seed"`
 	SessionID               string   `json:"session_id"`
 	ShowOnlyFilteredImage   bool     `json:"show_only_filtered_image"`
 	StreamImageProgress     bool     `json:"stream_image_progress"`
@@ -101,18 +199,141 @@ type RenderParams struct {
 	Prompt            string
 	OrigPrompt        string
 	NegativePrompt    string
-	Seed              uint32
+	Seed              uint64
+	UsedRandomSeed    bool
 	Width             int
+	WidthSet          bool // Set by the user.
 	Height            int
+	HeightSet         bool    // Set by the user.
+	AspectRatio       float64 // Width/height ratio, the size is calculated from it if set.
 	NumInferenceSteps int
 	NumOutputs        int
+	BatchSize         int // Max. count of outputs rendered at once.
 	GuidanceScale     float32
 	SamplerName       string
 	ModelName         string
+	VAEModel          string
+	VRAMUsageLevel    string
+	VRAMUsageLevelSet bool // Set by the user, per-model overrides are not applied.
+	ClipSkip          bool
+	ClipSkipSet       bool // Set by the user, per-model overrides are not applied.
+	RenderDevice      string
+	RawOverrides      map[string]any
+	SessionID         string
+	// If set, each variation is rendered separately with consecutive seeds.
+	Variations int
+	// Each combination of the sweep axis values is rendered separately.
+	SweepAxes      []SweepAxis
+	HiresFactor    float64
+	HiresDenoise   float32
+	RefinerModel   string
+	RefinerSet     bool    // Set by the user, per-model overrides are not applied.
+	RefinerSwitch  float32 // Fraction of the steps after which the refiner takes over.
+	InitImage      []byte  // JPEG image used for img2img.
+	PromptStrength float32 // How much the init image is changed.
+	Mask           []byte  // PNG inpainting mask, the white area of the init image is changed.
+	// Expanded prompts of a dynamic prompt, each of them is rendered separately.
+	DynamicPrompts []string
+	Combinatorial  bool
+	Anim           *AnimParams   // Set if the frames of an animation are rendered.
+	Extend         *ExtendParams // Set if a photo is extended by outpainting.
+}
+
+type SweepAxis struct {
+	Attr   string
+	Values []string
+}
+
+// Applies the per-model overrides for the currently set model, if not set by the user. The fields are reset
+// to the bot's defaults first, so the previous model's overrides don't carry over.
+func (p *RenderParams) applyModelOverrides() {
+	cfg := params.ModelConfigs[p.ModelName]
+	p.VAEModel = cfg.VAE
+	if !p.VRAMUsageLevelSet {
+		p.VRAMUsageLevel = params.DefaultVRAMUsageLevel
+		if cfg.VRAMUsageLevel != "" {
+			p.VRAMUsageLevel = cfg.VRAMUsageLevel
+		}
+	}
+	if !p.ClipSkipSet {
+		p.ClipSkip = params.DefaultClipSkip
+		if cfg.ClipSkip != nil {
+			p.ClipSkip = *cfg.ClipSkip
+		}
+	}
+	if !p.RefinerSet {
+		p.RefinerModel = cfg.Refiner
+	}
+}
+
+func (p *RenderParams) getSweepAxis(attr string) *SweepAxis {
+	for i := range p.SweepAxes {
+		if p.SweepAxes[i].Attr == attr {
+			return &p.SweepAxes[i]
+		}
+	}
+	return nil
 }
 
-func (r *ReqType) Render(params RenderParams) (taskID uint64, err error) {
-	postData, err := json.Marshal(RenderReq{
+// Returns the labels of the sweep grid's columns and rows.
+func (p *RenderParams) getSweepGridLabels() (colLabels, rowLabels []string) {
+	for i, axis := range p.SweepAxes {
+		for _, v := range axis.Values {
+			if i == 0 {
+				colLabels = append(colLabels, axis.Attr+": "+v)
+			} else {
+				rowLabels = append(rowLabels, axis.Attr+": "+v)
+			}
+		}
+	}
+	return
+}
+
+func (p *RenderParams) getSweepCellCount() int {
+	if len(p.SweepAxes) == 0 {
+		return 0
+	}
+	count := 1
+	for _, axis := range p.SweepAxes {
+		count *= len(axis.Values)
+	}
+	return count
+}
+
+// Returns the Easy Diffusion session ID of the given Telegram user. It's derived from the user ID, so the
+// mapping stays the same between bot restarts.
+func getSessionID(userID int64) string {
+	return fmt.Sprint("telegram-", userID)
+}
+
+// Parses the raw override value as JSON, falls back to using it as a string.
+func parseRawOverrideValue(val string) any {
+	var v any
+	if err := json.Unmarshal([]byte(val), &v); err != nil {
+		return val
+	}
+	return v
+}
+
+// Checks if the value has the right type for the field. Fields unknown to RenderReq are passed raw.
+func validateRawOverride(field string, value any) error {
+	if !rawOverrideFieldRegex.MatchString(field) {
+		return fmt.Errorf("invalid field name %s", field)
+	}
+	b, err := json.Marshal(map[string]any{field: value})
+	if err != nil {
+		return err
+	}
+	var r RenderReq
+	if err := json.Unmarshal(b, &r); err != nil {
+		return fmt.Errorf("invalid value for field %s", field)
+	}
+	return nil
+}
+
+func (r *ReqType) Render(params RenderParams) (taskID uint64, streamPath string, err error) {
+	renderReq := RenderReq{
+		ClipSkip:                params.ClipSkip,
 		GuidanceScale:           params.GuidanceScale,
 		Height:                  uint32(params.Height),
 		MetadataOutputFormat:    "none",
@@ -123,43 +344,96 @@ func (r *ReqType) Render(params RenderParams) (taskID uint64, err error) {
 		OutputFormat:            "jpeg",
 		OutputQuality:           75,
 		Prompt:                  params.Prompt,
+		RenderDevice:            params.RenderDevice,
 		SamplerName:             params.SamplerName,
 		Seed:                    params.Seed,
-		SessionID:               fmt.Sprint(rand.Uint32()),
+		SessionID:               params.SessionID,
 		ShowOnlyFilteredImage:   true,
 		StreamProgressUpdates:   true,
 		Tiling:                  "none",
 		UseStableDiffusionModel: params.ModelName,
-		UsedRandomSeed:          true,
-		VRAMUsageLevel:          "high",
+		UseVaeModel:             params.VAEModel,
+		UsedRandomSeed:          params.UsedRandomSeed,
+		VRAMUsageLevel:          params.VRAMUsageLevel,
 		Width:                   uint32(params.Width),
-	})
+	}
+
+	if len(params.InitImage) > 0 {
+		renderReq.InitImage = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(params.InitImage)
+		renderReq.PromptStrength = params.PromptStrength
+	}
+	if len(params.Mask) > 0 {
+		renderReq.Mask = "data:image/png;base64," + base64.StdEncoding.EncodeToString(params.Mask)
+	}
+
+	postData, err := json.Marshal(renderReq)
 	if err != nil {
-		return 0, err
+		return 0, "", err
+	}
+
+	if len(params.RawOverrides) > 0 {
+		var fields map[string]any
+		if err = json.Unmarshal(postData, &fields); err != nil {
+			return 0, "", err
+		}
+		for field, value := range params.RawOverrides {
+			fields[field] = value
+		}
+		if postData, err = json.Marshal(fields); err != nil {
+			return 0, "", err
+		}
 	}
 
 	res, err := r.req("/render", postData)
 	if err != nil {
-		return 0, err
+		var statusErr *ReqStatusError
+		if errors.As(err, &statusErr) && isModelLoadErrorDetail(statusErr.Detail) {
+			return 0, "", fmt.Errorf("%w: %s", ErrModelLoad, statusErr.Detail)
+		}
+		return 0, "", err
 	}
 
 	var renderResp struct {
-		Status string `json:"status"`
-		Task   uint64 `json:"task"`
+		Status string          `json:"status"`
+		Task   json.RawMessage `json:"task"`
+		Stream string          `json:"stream"`
 	}
 	err = json.Unmarshal([]byte(res), &renderResp)
-	if err != nil || renderResp.Status != "Online" {
-		return 0, err
+	if err != nil {
+		return 0, "", err
 	}
-	if renderResp.Task == 0 {
-		return 0, fmt.Errorf("unknown error")
+	// Any status is accepted if the task got queued, the server can still be finishing a previous task.
+	// The task ID can be sent as a number or as a string.
+	taskID, _ = strconv.ParseUint(strings.Trim(string(renderResp.Task), `"`), 10, 64)
+	if taskID == 0 {
+		if renderResp.Status != "" {
+			return 0, "", fmt.Errorf("got status %s", renderResp.Status)
+		}
+		return 0, "", fmt.Errorf("unknown error")
 	}
 
-	return renderResp.Task, nil
+	streamPath = renderResp.Stream
+	if streamPath == "" {
+		streamPath = fmt.Sprintf(streamPathFmt, taskID)
+	}
+	return taskID, streamPath, nil
 }
 
 func (r *ReqType) Stop(taskID uint64) {
-	_, _ = r.req(fmt.Sprint("/image/stop?task=", taskID), nil)
+	query := url.Values{"task": {strconv.FormatUint(taskID, 10)}}
+	_, _ = r.req("/image/stop?"+query.Encode(), nil)
+}
+
+func isOutOfMemoryDetail(detail string) bool {
+	detail = strings.ToLower(detail)
+	return strings.Contains(detail, "out of memory") || strings.Contains(detail, "not enough memory")
+}
+
+func isModelLoadErrorDetail(detail string) bool {
+	detail = strings.ToLower(detail)
+	return strings.Contains(detail, "could not find the desired model") ||
+		strings.Contains(detail, "could not load the stable-diffusion model") ||
+		strings.Contains(detail, "error loading model")
 }
 
 func (r *ReqType) processProgressSection(section string) (progress int, imgs [][]byte, err error) {
@@ -209,6 +483,12 @@ func (r *ReqType) processProgressSection(section string) (progress int, imgs [][
 					imgs = append(imgs, unbased)
 				}
 			} else {
+				if isModelLoadErrorDetail(resultResp.Detail) {
+					return progress, nil, fmt.Errorf("%w: %s", ErrModelLoad, resultResp.Detail)
+				}
+				if isOutOfMemoryDetail(resultResp.Detail) {
+					return progress, nil, fmt.Errorf("%w: got status %s: %s", ErrOutOfMemory, resultResp.Status, resultResp.Detail)
+				}
 				return progress, nil, fmt.Errorf("got status %s: %s", resultResp.Status, resultResp.Detail)
 			}
 		}
@@ -217,10 +497,14 @@ func (r *ReqType) processProgressSection(section string) (progress int, imgs [][
 	return progress, imgs, nil
 }
 
-func (r *ReqType) GetProgress(taskID uint64) (progress int, imgs [][]byte, err error) {
+func (r *ReqType) GetProgress(streamPath string) (progress int, imgs [][]byte, err error) {
 	var res string
-	res, err = r.req(fmt.Sprint("/image/stream/", taskID), nil)
+	res, err = r.req(streamPath, nil)
 	if err != nil {
+		var statusErr *ReqStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooEarly { // Task not started yet.
+			return 0, nil, nil
+		}
 		return 0, nil, err
 	}
 
@@ -15,4 +15,20 @@ ALLOWED_GROUPIDS=$ALLOWED_GROUPIDS \
 DELAYED_ED_START=$DELAYED_ED_START \
 DEFAULT_MODEL=$DEFAULT_MODEL \
 DEFAULT_SAMPLER=$DEFAULT_SAMPLER \
+RETRY_COUNT=$RETRY_COUNT \
+RETRY_DELAY=$RETRY_DELAY \
+QUEUED_ENTRY_EXPIRY=$QUEUED_ENTRY_EXPIRY \
+MAX_OUTPUTS=$MAX_OUTPUTS \
+BATCH_SIZE=$BATCH_SIZE \
+OOM_RECOVERY=$OOM_RECOVERY \
+MODEL_FALLBACK=$MODEL_FALLBACK \
+DEFAULT_VRAM_USAGE_LEVEL=$DEFAULT_VRAM_USAGE_LEVEL \
+DEFAULT_CLIP_SKIP=$DEFAULT_CLIP_SKIP \
+RENDER_DEVICE=$RENDER_DEVICE \
+WILDCARDS_PATH=$WILDCARDS_PATH \
+DEFAULT_HIRES_DENOISE=$DEFAULT_HIRES_DENOISE \
+DEFAULT_REFINER_SWITCH=$DEFAULT_REFINER_SWITCH \
+MODEL_CONFIG=$MODEL_CONFIG \
+SCHEDULING=$SCHEDULING \
+SCHEDULING_WEIGHTS=$SCHEDULING_WEIGHTS \
 $bin $*
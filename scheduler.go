@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// Entries are scheduled with start-time fair queueing. Each user (or chat) gets a virtual time, which is
+// increased by 1/weight for each of their entries. Entries with lower virtual times are processed first,
+// so users with waiting entries take turns.
+
+// Returns the ID of the user or chat the entry is scheduled for.
+func getSchedulingKey(message *models.Message) int64 {
+	if params.Scheduling == "chat" {
+		return message.Chat.ID
+	}
+	return message.From.ID
+}
+
+func getSchedulingWeight(key int64) float64 {
+	if weight, ok := params.SchedulingWeights[key]; ok {
+		return weight
+	}
+	return 1
+}
+
+// Sets the virtual time of the new entry. The queue's mutex should be locked.
+func (q *DownloadQueue) scheduleEntry(qEntry *DownloadQueueEntry) {
+	if params.Scheduling == "fifo" {
+		qEntry.virtualTime = float64(qEntry.ID)
+		return
+	}
+
+	key := getSchedulingKey(qEntry.Message)
+	start := q.virtualTime
+	if last, ok := q.lastVirtualTimes[key]; ok && last > start {
+		start = last
+	}
+	qEntry.virtualTime = start + 1/getSchedulingWeight(key)
+	q.lastVirtualTimes[key] = qEntry.virtualTime
+}
+
+// Returns the waiting entries in the order they will be processed. The queue's mutex should be locked.
+func (q *DownloadQueue) getWaitingEntries() (res []*DownloadQueueEntry) {
+	for _, e := range q.entries {
+		if e != q.currentEntry {
+			res = append(res, e)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].virtualTime != res[j].virtualTime {
+			return res[i].virtualTime < res[j].virtualTime
+		}
+		return res[i].ID < res[j].ID
+	})
+	return
+}
+
+// Returns the entry which should be processed next and advances the virtual time. The queue's mutex should
+// be locked.
+func (q *DownloadQueue) getNextEntry() *DownloadQueueEntry {
+	waiting := q.getWaitingEntries()
+	if len(waiting) == 0 {
+		return nil
+	}
+	next := waiting[0]
+	if next.virtualTime > q.virtualTime {
+		q.virtualTime = next.virtualTime
+	}
+
+	// Forgetting users without waiting entries, their next entry starts from the current virtual time.
+	for key, last := range q.lastVirtualTimes {
+		if last <= q.virtualTime {
+			delete(q.lastVirtualTimes, key)
+		}
+	}
+	return next
+}
+
+type queuePositionUpdate struct {
+	entry *DownloadQueueEntry
+	pos   int
+}
+
+// Updates the queue positions of the waiting entries, and returns the entries whose position has changed.
+// The queue's mutex should be locked, the updates should be sent with sendQueuePositionUpdates() after
+// unlocking it.
+func (q *DownloadQueue) updateQueuePositions() (updates []queuePositionUpdate) {
+	for i, e := range q.getWaitingEntries() {
+		pos := i + 1
+		if e.queuePosition == pos {
+			continue
+		}
+		if e.queuePosition == 0 {
+			fmt.Println("  queueing request #", e.ID, "at position #", pos)
+		}
+		e.queuePosition = pos
+		updates = append(updates, queuePositionUpdate{entry: e, pos: pos})
+	}
+	return
+}
+
+// Sends the new queue positions, skipping the ones which got outdated since the update. The check is done
+// with the entry's reply mutex locked, so an outdated position can't overwrite a reply sent after it, like the
+// start of the render.
+func (q *DownloadQueue) sendQueuePositionUpdates(updates []queuePositionUpdate) {
+	for _, u := range updates {
+		u.entry.replyMutex.Lock()
+		q.mutex.Lock()
+		outdated := u.entry.State != EntryStateQueued || u.entry.queuePosition != u.pos
+		q.mutex.Unlock()
+		if !outdated {
+			u.entry.sendReplyLocked(q.ctx, q.getQueuePositionString(u.entry, u.pos))
+		}
+		u.entry.replyMutex.Unlock()
+	}
+}
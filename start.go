@@ -11,9 +11,13 @@ import (
 const easyDiffusionStartTimeout = 30 * time.Second
 const easyDiffusionPingInterval = 500 * time.Millisecond
 
-func startEasyDiffusionIfNeeded() error {
+func isEasyDiffusionRunning() bool {
 	out, err := exec.Command("pgrep", "uvicorn").Output()
-	if err == nil && len(out) > 0 {
+	return err == nil && len(out) > 0
+}
+
+func startEasyDiffusionIfNeeded() error {
+	if isEasyDiffusionRunning() {
 		fmt.Println("easy-diffusion is already running")
 	} else {
 		fmt.Println("starting easy-diffusion... ")
@@ -52,5 +56,6 @@ func startEasyDiffusionIfNeeded() error {
 		fmt.Println("  ping...")
 	}
 	fmt.Println("  ok")
-	return nil
+
+	return req.DetectVersion()
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+type EDVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v EDVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// A supported Easy Diffusion API version. The bot uses the same requests for all of them, statuses and task
+// IDs are parsed leniently, so no version specific settings are needed.
+type EDAPICompat struct {
+	Name string
+}
+
+var edAPICompatV2 = EDAPICompat{Name: "2.5.x"}
+var edAPICompatV3 = EDAPICompat{Name: "3.x"}
+
+// The web UI shows the version in the <small> element of its title, like <small>v2.5.48 <span ...
+var edVersionRegex = regexp.MustCompile(`<small>\s*v([0-9]+)\.([0-9]+)\.([0-9]+)\b`)
+
+// Parses the Easy Diffusion version from the web UI's index page.
+func parseEDVersion(indexHTML string) (v EDVersion, ok bool) {
+	match := edVersionRegex.FindStringSubmatch(indexHTML)
+	if len(match) < 4 {
+		return v, false
+	}
+	v.Major, _ = strconv.Atoi(match[1])
+	v.Minor, _ = strconv.Atoi(match[2])
+	v.Patch, _ = strconv.Atoi(match[3])
+	return v, true
+}
+
+func getEDAPICompat(v EDVersion) (*EDAPICompat, error) {
+	switch {
+	case v.Major == 2 && v.Minor >= 5:
+		return &edAPICompatV2, nil
+	case v.Major == 3:
+		return &edAPICompatV3, nil
+	}
+	return nil, fmt.Errorf("unsupported easy diffusion version %s, supported versions are %s and %s", v,
+		edAPICompatV2.Name, edAPICompatV3.Name)
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestParseEDVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		v    EDVersion
+		ok   bool
+	}{
+		{
+			name: "2.5",
+			html: `<h1 id="logo"><img src="/media/images/icon-512x512.png">Easy Diffusion <small>v2.5.48 <span id="updateBranchLabel"></span></small></h1>`,
+			v:    EDVersion{2, 5, 48},
+			ok:   true,
+		},
+		{
+			name: "3.0",
+			html: `<small>v3.0.9 <span id="updateBranchLabel">(beta)</span></small>`,
+			v:    EDVersion{3, 0, 9},
+			ok:   true,
+		},
+		{
+			name: "other versions before the title",
+			html: `<script src="/media/js/jquery-3.6.1.min.js?v=1.2.3"></script><small>v2.5.41</small>`,
+			v:    EDVersion{2, 5, 41},
+			ok:   true,
+		},
+		{
+			name: "version outside the title",
+			html: `<script src="/media/js/lib.js?v1.2.3"></script>`,
+		},
+		{
+			name: "no version",
+			html: `<small>Easy Diffusion</small>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, ok := parseEDVersion(test.html)
+			if ok != test.ok || v != test.v {
+				t.Errorf("expected %s %v, got %s %v", test.v, test.ok, v, ok)
+			}
+		})
+	}
+}
+
+func TestGetEDAPICompat(t *testing.T) {
+	tests := []struct {
+		v      EDVersion
+		compat *EDAPICompat
+	}{
+		{EDVersion{2, 4, 13}, nil},
+		{EDVersion{2, 5, 0}, &edAPICompatV2},
+		{EDVersion{2, 5, 48}, &edAPICompatV2},
+		{EDVersion{3, 0, 9}, &edAPICompatV3},
+		{EDVersion{3, 1, 0}, &edAPICompatV3},
+		{EDVersion{4, 0, 0}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.v.String(), func(t *testing.T) {
+			compat, err := getEDAPICompat(test.v)
+			if compat != test.compat {
+				t.Errorf("expected %v, got %v", test.compat, compat)
+			}
+			if (err != nil) != (test.compat == nil) {
+				t.Errorf("unexpected error result: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const maxDynamicPrompts = 25
+const maxDynamicPromptDepth = 10
+
+var wildcardRegex = regexp.MustCompile(`__([A-Za-z0-9_/-]+?)__`)
+
+// A part of a dynamic prompt. It's either a literal text, or a list of alternatives.
+type dynamicPromptPart struct {
+	text         string
+	alternatives []string
+}
+
+func hasDynamicPrompt(prompt string) bool {
+	return strings.Contains(prompt, "{") || wildcardRegex.MatchString(prompt)
+}
+
+// Returns the non-empty, non-comment lines of the wildcard's file.
+func loadWildcard(name string) ([]string, error) {
+	if params.WildcardsPath == "" {
+		return nil, fmt.Errorf("wildcards are not configured")
+	}
+	if strings.Contains(name, "..") {
+		return nil, fmt.Errorf("invalid wildcard %s", name)
+	}
+	b, err := os.ReadFile(filepath.Join(params.WildcardsPath, name+".txt"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown wildcard %s", name)
+	}
+	var res []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		res = append(res, line)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("wildcard %s is empty", name)
+	}
+	return res, nil
+}
+
+// Splits the alternatives at the top level | characters.
+func splitAlternatives(s string) (res []string) {
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '|':
+			if depth == 0 {
+				res = append(res, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, s[start:])
+}
+
+func parseDynamicPrompt(prompt string) (parts []dynamicPromptPart, err error) {
+	for len(prompt) > 0 {
+		braceStart := strings.IndexByte(prompt, '{')
+		wildcardLoc := wildcardRegex.FindStringSubmatchIndex(prompt)
+
+		if wildcardLoc != nil && (braceStart < 0 || wildcardLoc[0] < braceStart) {
+			alternatives, err := loadWildcard(prompt[wildcardLoc[2]:wildcardLoc[3]])
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, dynamicPromptPart{text: prompt[:wildcardLoc[0]]}, dynamicPromptPart{alternatives: alternatives})
+			prompt = prompt[wildcardLoc[1]:]
+			continue
+		}
+
+		if braceStart < 0 {
+			parts = append(parts, dynamicPromptPart{text: prompt})
+			break
+		}
+
+		depth := 0
+		braceEnd := -1
+		for i := braceStart; i < len(prompt) && braceEnd < 0; i++ {
+			switch prompt[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					braceEnd = i
+				}
+			}
+		}
+		if braceEnd < 0 {
+			return nil, fmt.Errorf("unclosed { in prompt")
+		}
+		parts = append(parts, dynamicPromptPart{text: prompt[:braceStart]},
+			dynamicPromptPart{alternatives: splitAlternatives(prompt[braceStart+1 : braceEnd])})
+		prompt = prompt[braceEnd+1:]
+	}
+	return
+}
+
+// Returns the prompt with a randomly chosen alternative for each {a|b} group and wildcard.
+func expandPromptRandom(prompt string, depth int) (string, error) {
+	if depth > maxDynamicPromptDepth {
+		return "", fmt.Errorf("dynamic prompt nesting is too deep")
+	}
+	parts, err := parseDynamicPrompt(prompt)
+	if err != nil {
+		return "", err
+	}
+	var res string
+	for _, part := range parts {
+		if part.alternatives == nil {
+			res += part.text
+			continue
+		}
+		alternative, err := expandPromptRandom(part.alternatives[rand.Intn(len(part.alternatives))], depth+1)
+		if err != nil {
+			return "", err
+		}
+		res += alternative
+	}
+	return res, nil
+}
+
+// Returns all combinations of the alternatives of the prompt's {a|b} groups and wildcards.
+func expandPromptCombinatorial(prompt string, depth int) ([]string, error) {
+	if depth > maxDynamicPromptDepth {
+		return nil, fmt.Errorf("dynamic prompt nesting is too deep")
+	}
+	parts, err := parseDynamicPrompt(prompt)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{""}
+	for _, part := range parts {
+		if part.alternatives == nil {
+			for i := range res {
+				res[i] += part.text
+			}
+			continue
+		}
+
+		var expanded []string
+		for _, alternative := range part.alternatives {
+			e, err := expandPromptCombinatorial(alternative, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, e...)
+		}
+
+		var newRes []string
+		for _, r := range res {
+			for _, e := range expanded {
+				newRes = append(newRes, r+e)
+				if len(newRes) > maxDynamicPrompts {
+					return nil, fmt.Errorf("too many prompt combinations, max. is %d", maxDynamicPrompts)
+				}
+			}
+		}
+		res = newRes
+	}
+	return res, nil
+}